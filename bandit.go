@@ -0,0 +1,108 @@
+package proxypool
+
+import (
+	"errors"
+	"time"
+
+	"github.com/garyburd/redigo/redis"
+	"github.com/seaguest/log"
+)
+
+const (
+	defaultBanditHalfLife    = time.Hour * 1 // in hours
+	defaultBanditExploreRate = 0.1
+)
+
+// Thompson sampling helpers of StrategyBandit.
+// KEYS: 10 bandit; ARGV: 18 now in milliseconds, 23 half-life in milliseconds
+const banditLua = `
+	-- successes and failures of member, decayed by half every half-life since the last outcome
+	local function counts(member)
+	    local c = redis.call('HMGET', KEYS[10], member .. ':s', member .. ':f', member .. ':t')
+	    local s, f = tonumber(c[1]) or 0, tonumber(c[2]) or 0
+	    local k = 0.5 ^ ((tonumber(ARGV[18]) - (tonumber(c[3]) or tonumber(ARGV[18]))) / tonumber(ARGV[23]))
+	    return s * k, f * k
+	end
+
+	local function normal()
+	    local u = math.max(math.random(), 1e-12)
+	    return math.sqrt(-2 * math.log(u)) * math.cos(2 * math.pi * math.random())
+	end
+
+	-- Marsaglia and Tsang, for a >= 1
+	local function gamma(a)
+	    local d = a - 1 / 3
+	    local c = 1 / math.sqrt(9 * d)
+	    while true do
+	        local x, v
+	        repeat
+	            x = normal()
+	            v = 1 + c * x
+	        until v > 0
+	        v = v * v * v
+	        local u = math.random()
+	        if u < 1 - 0.0331 * x ^ 4 or math.log(u) < 0.5 * x * x + d * (1 - v + math.log(v)) then
+	            return d * v
+	        end
+	    end
+	end
+
+	local function beta(a, b)
+	    local x = gamma(a)
+	    return x / (x + gamma(b))
+	end
+`
+
+// record an outcome of member, decaying its counts since the last one.
+// KEYS: 1 bandit; ARGV: 1 member, 2 success 1 or 0, 3 now in milliseconds, 4 half-life in milliseconds
+var learnScript = redis.NewScript(1, `
+	local m = ARGV[1]
+	local now = tonumber(ARGV[3])
+	local c = redis.call('HMGET', KEYS[1], m .. ':s', m .. ':f', m .. ':t')
+	local k = 0.5 ^ ((now - (tonumber(c[3]) or now)) / tonumber(ARGV[4]))
+	local s, f = (tonumber(c[1]) or 0) * k, (tonumber(c[2]) or 0) * k
+	if ARGV[2] == '1' then
+	    s = s + 1
+	else
+	    f = f + 1
+	end
+	redis.call('HMSET', KEYS[1], m .. ':s', s, m .. ':f', f, m .. ':t', now)
+	return 1`)
+
+// feed the outcome of a proxy to StrategyBandit, nothing is recorded under the other strategies.
+func (p *ProxyPool) learn(member string, success bool) {
+	if p.config().Strategy != StrategyBandit {
+		return
+	}
+
+	c := p.pool.Get()
+	defer c.Close()
+
+	if _, err := learnScript.Do(c, p.learnArgs(member, success)...); err != nil {
+		log.Error(err)
+	}
+}
+
+func (p *ProxyPool) learnArgs(member string, success bool) redis.Args {
+	return redis.Args{}.Add(p.keys.poolBanditKey(p.channel), member, success, p.nowMillis(),
+		int64(p.config().BanditHalfLife/time.Millisecond))
+}
+
+// forget the counts of a member gone from proxy center.
+func (p *ProxyPool) forget(member string) error {
+	c := p.pool.Get()
+	defer c.Close()
+
+	_, err := c.Do("HDEL", p.keys.poolBanditKey(p.channel), member+":s", member+":f", member+":t")
+	return err
+}
+
+func validBandit(c *PoolConfig) error {
+	if c.BanditHalfLife <= 0 {
+		return errors.New("pool bandit_half_life must be positive")
+	}
+	if c.BanditExploreRate < 0 || c.BanditExploreRate > 1 {
+		return errors.New("pool bandit_explore_rate must be within 0 and 1")
+	}
+	return nil
+}
@@ -0,0 +1,210 @@
+package proxypool
+
+import (
+	"time"
+
+	"github.com/garyburd/redigo/redis"
+	"github.com/seaguest/log"
+)
+
+// settle the leases and return the proxies with their score increased, like freeScript for each lease.
+// KEYS: 7 waiters, 8 blocked, 9 cooldown; ARGV: 7 incr, 8 now, 9 wake prefix, 10 alive prefix, 11 cooldown,
+// then lease and member pairs
+var freeNScript = redis.NewScript(9, leaseLua+settleLua+`
+	local freed = 0
+	for i = 12, #ARGV, 2 do
+	    local score = release(ARGV[i], ARGV[i + 1])
+	    if score then
+	        settle(ARGV[i + 1], score, tonumber(ARGV[7]), ARGV[8], ARGV[9], ARGV[10], ARGV[11])
+	        freed = freed + 1
+	    end
+	end
+	return freed`)
+
+// settle the leases if any, and block the proxies in channel, like deleteScript for each lease.
+// KEYS: 7 blocked; ARGV: 7 end of the block in seconds, then lease and member pairs
+var deleteNScript = redis.NewScript(7, leaseLua+`
+	for i = 8, #ARGV, 2 do
+	    if ARGV[i] ~= '' then
+	        release(ARGV[i], ARGV[i + 1])
+	    end
+	    redis.call('ZADD', KEYS[7], ARGV[7], ARGV[i + 1])
+	    redis.call('ZREM', KEYS[1], ARGV[i + 1])
+	end
+	return 1`)
+
+// take up to n proxies at once in a single script, reloading the channel once if fewer are available.
+// the proxies are distinct, even with a Concurrency above 1.
+// fewer than n proxies are returned if the channel runs short, none if it is empty.
+// every proxy is leased like with Take, and must be settled with Free, FreeN, Delete or DeleteN.
+func (p *ProxyPool) TakeN(n int) []*Member {
+	return p.TakeNWith(nil, n)
+}
+
+// take up to n proxies matching the criteria at once like TakeN, see TakeWith.
+func (p *ProxyPool) TakeNWith(criteria *Criteria, n int) []*Member {
+	if n <= 0 {
+		return nil
+	}
+
+	proxies, err := p.selectLeases(criteria, n, nil)
+	if err != nil {
+		log.Error(err)
+		return nil
+	}
+
+	if len(proxies) < n {
+		p.reload()
+
+		more, err := p.selectLeases(criteria, n-len(proxies), proxies)
+		if err != nil {
+			log.Error(err)
+		}
+		proxies = append(proxies, more...)
+	}
+
+	if criteria != nil {
+		for _, proxy := range proxies {
+			proxy.Host = criteria.Host
+		}
+	}
+	return proxies
+}
+
+// settle the leases of the proxies and return them to proxy_pool in a single script, like Free for each proxy.
+func (p *ProxyPool) FreeN(proxies []*Member) {
+	var leased []*Member
+	for _, proxy := range proxies {
+		if isTunnel(proxy) {
+			continue
+		}
+		if proxy.Lease == "" {
+			p.Free(proxy)
+			continue
+		}
+
+		leased = append(leased, proxy)
+	}
+
+	if len(leased) == 0 {
+		return
+	}
+	p.recordN(leased, true)
+
+	freed, err := p.freeLeases(leased, 1, p.config().Cooldown)
+	if err != nil {
+		log.Error(err)
+		return
+	}
+
+	if freed < len(leased) {
+		log.Errorf("[%d] leases expired, proxies already reclaimed", len(leased)-freed)
+	}
+}
+
+// block the proxies in channel in a single script, like Delete for each proxy.
+func (p *ProxyPool) DeleteN(proxies []*Member) {
+	var blocked []*Member
+	for _, proxy := range proxies {
+		if isTunnel(proxy) {
+			continue
+		}
+
+		blocked = append(blocked, proxy)
+	}
+
+	if len(blocked) == 0 {
+		return
+	}
+	p.recordN(blocked, false)
+
+	if err := p.deleteLeases(blocked); err != nil {
+		log.Error(err)
+	}
+}
+
+// record the outcome of the proxies in one round trip, like learn for each proxy,
+// then burn and strikeSubnet on failure.
+func (p *ProxyPool) recordN(proxies []*Member, success bool) {
+	conf := p.config()
+
+	c := p.pool.Get()
+	defer c.Close()
+
+	if err := c.Err(); err != nil {
+		log.Error(err)
+		return
+	}
+
+	// one reply per script sent, the strikes reply the subnet they blocked
+	var strikes []bool
+	for _, proxy := range proxies {
+		if conf.Strategy == StrategyBandit {
+			learnScript.Send(c, p.learnArgs(proxy.Member, success)...)
+			strikes = append(strikes, false)
+		}
+		if success {
+			continue
+		}
+		if proxy.Host != "" {
+			burnScript.Send(c, p.burnArgs(proxy)...)
+			strikes = append(strikes, false)
+		}
+		if conf.SubnetFailureLimit > 0 {
+			subnetFailureScript.Send(c, p.strikeArgs(proxy.Member)...)
+			strikes = append(strikes, true)
+		}
+	}
+	if len(strikes) == 0 {
+		return
+	}
+
+	replies, err := redis.Values(c.Do(""))
+	if err != nil {
+		log.Error(err)
+		return
+	}
+	for i, reply := range replies {
+		if err, ok := reply.(redis.Error); ok {
+			log.Error(err)
+			continue
+		}
+		if i < len(strikes) && strikes[i] {
+			subnet, _ := redis.String(reply, nil)
+			p.subnetBlocked(subnet)
+		}
+	}
+}
+
+// settle the leases, the proxies are not eligible again before the cooldown, 0 for none.
+func (p *ProxyPool) freeLeases(proxies []*Member, incr int, cooldown time.Duration) (int, error) {
+	c := p.pool.Get()
+	defer c.Close()
+
+	if err := c.Err(); err != nil {
+		return 0, err
+	}
+
+	args := p.leaseArgs(p.keys.poolWaitersKey(p.channel), p.keys.poolBlockedKey(p.channel), p.keys.poolCooldownKey(p.channel)).
+		Add(incr, p.nowMillis(), p.keys.poolWakePrefix(p.channel), p.keys.poolAlivePrefix(p.channel), int64(cooldown/time.Millisecond))
+	for _, proxy := range proxies {
+		args = args.Add(proxy.Lease, proxy.Member)
+	}
+	return redis.Int(freeNScript.Do(c, args...))
+}
+
+func (p *ProxyPool) deleteLeases(proxies []*Member) error {
+	c := p.pool.Get()
+	defer c.Close()
+
+	if err := c.Err(); err != nil {
+		return err
+	}
+
+	args := p.leaseArgs(p.keys.poolBlockedKey(p.channel)).Add(p.blockEnd())
+	for _, proxy := range proxies {
+		args = args.Add(proxy.Lease, proxy.Member)
+	}
+	_, err := deleteNScript.Do(c, args...)
+	return err
+}
@@ -0,0 +1,72 @@
+package proxypool
+
+import (
+	"testing"
+
+	"github.com/garyburd/redigo/redis"
+)
+
+func TestDeleteNRecordsOutcomes(t *testing.T) {
+	pp := newTestPool(t, "batch", func(c *Config) {
+		c.Pool.Strategy = StrategyBandit
+		c.Pool.SubnetFailureLimit = 2
+	})
+	for _, member := range []string{"10.0.0.1:80", "10.0.0.2:80", "10.0.1.1:80"} {
+		addTestProxy(t, pp, member, 10)
+	}
+	awaitChannel(t, pp, 3)
+
+	proxies := pp.TakeNWith(&Criteria{Host: "example.com"}, 3)
+	if len(proxies) != 3 {
+		t.Fatalf("took %d proxies", len(proxies))
+	}
+	pp.DeleteN(proxies)
+
+	c := pp.pool.Get()
+	defer c.Close()
+
+	for _, proxy := range proxies {
+		if f, err := redis.Float64(c.Do("HGET", pp.keys.poolBanditKey(pp.channel), proxy.Member+":f")); err != nil || f != 1 {
+			t.Errorf("%s failures %v, %v", proxy.Member, f, err)
+		}
+		if _, err := redis.Int64(c.Do("ZSCORE", pp.keys.burnKey("example.com"), proxy.Member)); err != nil {
+			t.Errorf("%s not burnt, %v", proxy.Member, err)
+		}
+		if _, err := redis.Int64(c.Do("ZSCORE", pp.keys.poolBlockedKey(pp.channel), proxy.Member)); err != nil {
+			t.Errorf("%s not blocked, %v", proxy.Member, err)
+		}
+	}
+
+	subnets, err := redis.Strings(c.Do("ZRANGE", pp.keys.poolSubnetBlockedKey(pp.channel), 0, -1))
+	if err != nil || len(subnets) != 1 || subnets[0] != "10.0.0.0/24" {
+		t.Errorf("blocked subnets %v, %v", subnets, err)
+	}
+}
+
+func TestFreeNRecordsOutcomes(t *testing.T) {
+	pp := newTestPool(t, "batch", func(c *Config) {
+		c.Pool.Strategy = StrategyBandit
+	})
+	for _, member := range []string{"10.0.0.1:80", "10.0.0.2:80"} {
+		addTestProxy(t, pp, member, 10)
+	}
+	awaitChannel(t, pp, 2)
+
+	proxies := pp.TakeN(2)
+	if len(proxies) != 2 {
+		t.Fatalf("took %d proxies", len(proxies))
+	}
+	pp.FreeN(proxies)
+
+	c := pp.pool.Get()
+	defer c.Close()
+
+	for _, proxy := range proxies {
+		if s, err := redis.Float64(c.Do("HGET", pp.keys.poolBanditKey(pp.channel), proxy.Member+":s")); err != nil || s != 1 {
+			t.Errorf("%s successes %v, %v", proxy.Member, s, err)
+		}
+		if _, err := redis.Int64(c.Do("ZSCORE", pp.keys.poolKey(pp.channel), proxy.Member)); err != nil {
+			t.Errorf("%s not back in channel, %v", proxy.Member, err)
+		}
+	}
+}
@@ -0,0 +1,46 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"os"
+	"os/signal"
+	"syscall"
+
+	"github.com/seaguest/log"
+	"github.com/seaguest/proxypool"
+)
+
+// proxy center daemon, several replicas can run against the same redis, only the leader fetches and schedules.
+// the configuration is loaded from the file, then overridden by PROXYPOOL_* environment variables.
+func main() {
+	path := flag.String("config", "", "yaml or json config file")
+	flag.Parse()
+
+	conf, err := proxypool.LoadConfig(*path)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	if err := conf.LoadEnv(); err != nil {
+		log.Fatal(err)
+	}
+
+	center, err := proxypool.NewProxyCenterWithConfig(conf)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	// give up leadership and drain in-flight validations on exit
+	ctx, cancel := context.WithCancel(context.Background())
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		<-sig
+		cancel()
+	}()
+
+	if err := center.Run(ctx); err != nil {
+		log.Error(err)
+	}
+}
@@ -0,0 +1,160 @@
+package proxypool
+
+import (
+	"fmt"
+	"reflect"
+	"strings"
+
+	"github.com/garyburd/redigo/redis"
+	"github.com/seaguest/log"
+)
+
+// pool settings a channel may override at runtime, by yaml name
+var channelSettings = map[string]bool{
+	"strategy":             true,
+	"blocked_clean_period": true,
+	"concurrency":          true,
+	"cooldown":             true,
+	"min_anonymity":        true,
+	"protocols":            true,
+}
+
+// the pool configuration with the channel settings applied, validated.
+// durations are given like in the configuration file, e.g. 90s, and lists are comma separated.
+func applySettings(base PoolConfig, settings map[string]string) (*PoolConfig, error) {
+	c := base
+	v := reflect.ValueOf(&c).Elem()
+	t := v.Type()
+	for i := 0; i < t.NumField(); i++ {
+		tag := strings.Split(t.Field(i).Tag.Get("yaml"), ",")[0]
+		s, found := settings[tag]
+		if !found || !channelSettings[tag] {
+			continue
+		}
+		if err := setField(v.Field(i), s); err != nil {
+			return nil, fmt.Errorf("invalid channel setting [%s=%s]: %v", tag, s, err)
+		}
+	}
+
+	for name := range settings {
+		if !channelSettings[name] {
+			return nil, fmt.Errorf("unknown channel setting [%s]", name)
+		}
+	}
+
+	if err := c.Validate(); err != nil {
+		return nil, err
+	}
+	return &c, nil
+}
+
+// the live configuration of channel
+func (p *ProxyPool) config() *PoolConfig {
+	return p.conf.Load().(*PoolConfig)
+}
+
+// apply the settings of channel stored in redis on top of the base configuration.
+// invalid settings are rejected as a whole, the current configuration is kept.
+func (p *ProxyPool) loadSettings() error {
+	settings, err := getChannelSettings(p.keys, p.channel, p.pool)
+	if err != nil {
+		return err
+	}
+
+	conf, err := applySettings(p.base, settings)
+	if err != nil {
+		return fmt.Errorf("channel [%s]: %v", p.channel, err)
+	}
+
+	if !reflect.DeepEqual(conf, p.config()) {
+		p.conf.Store(conf)
+		log.Errorf("channel [%s] settings applied %v", p.channel, settings)
+	}
+	return nil
+}
+
+// the criteria of a take with the requirements of channel added.
+func (p *ProxyPool) channelCriteria(criteria *Criteria) *Criteria {
+	conf := p.config()
+	if conf.MinAnonymity == 0 && len(conf.Protocols) == 0 {
+		return criteria
+	}
+
+	merged := Criteria{}
+	if criteria != nil {
+		merged = *criteria
+	}
+	if merged.MinAnonymity < conf.MinAnonymity {
+		merged.MinAnonymity = conf.MinAnonymity
+	}
+	merged.Protocols = append(append([]string{}, conf.Protocols...), merged.Protocols...)
+	return &merged
+}
+
+// settings of the channel stored in redis, by yaml name.
+func GetChannelSettings(conf *Config, channel string) (map[string]string, error) {
+	pool := NewRedisPoolWithConfig(&conf.Redis)
+	defer pool.Close()
+
+	return getChannelSettings(keyspace{conf.KeyPrefix}, channel, pool)
+}
+
+// store settings of the channel overriding its pool configuration, and apply them live in every process of channel.
+// the settings are strategy, blocked_clean_period, concurrency, cooldown, min_anonymity and protocols,
+// given like in the configuration file, e.g. 90s for a duration and https,socks5 for a list.
+// conf gives the redis and the pool configuration of the processes of channel, the settings stored
+// are validated on top of its pool configuration, so that the processes do not reject them.
+func SetChannelSettings(conf *Config, channel string, settings map[string]string) error {
+	if len(settings) == 0 {
+		return fmt.Errorf("no setting given for channel [%s]", channel)
+	}
+
+	pool := NewRedisPoolWithConfig(&conf.Redis)
+	defer pool.Close()
+
+	keys := keyspace{conf.KeyPrefix}
+	merged, err := getChannelSettings(keys, channel, pool)
+	if err != nil {
+		return err
+	}
+	for name, value := range settings {
+		merged[name] = value
+	}
+	if _, err := applySettings(conf.Pool, merged); err != nil {
+		return err
+	}
+
+	c := pool.Get()
+	defer c.Close()
+
+	c.Send("HMSET", redis.Args{}.Add(keys.poolConfigKey(channel)).AddFlat(settings)...)
+	c.Send("PUBLISH", keys.eventChannel(), eventConfig+"|"+channel)
+	_, err = c.Do("")
+	return err
+}
+
+// remove settings of the channel, all of them if none is given, back to the pool configuration of each process.
+func ResetChannelSettings(conf *Config, channel string, names ...string) error {
+	pool := NewRedisPoolWithConfig(&conf.Redis)
+	defer pool.Close()
+
+	c := pool.Get()
+	defer c.Close()
+
+	keys := keyspace{conf.KeyPrefix}
+	if len(names) == 0 {
+		c.Send("DEL", keys.poolConfigKey(channel))
+	} else {
+		c.Send("HDEL", redis.Args{}.Add(keys.poolConfigKey(channel)).AddFlat(names)...)
+	}
+	c.Send("PUBLISH", keys.eventChannel(), eventConfig+"|"+channel)
+	_, err := c.Do("")
+	return err
+}
+
+func getChannelSettings(keys keyspace, channel string, pool *redis.Pool) (map[string]string, error) {
+	c := pool.Get()
+	defer c.Close()
+
+	return redis.StringMap(c.Do("HGETALL", keys.poolConfigKey(channel)))
+}
@@ -0,0 +1,58 @@
+package proxypool
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestApplySettings(t *testing.T) {
+	base := DefaultConfig().Pool
+
+	tests := []struct {
+		name     string
+		settings map[string]string
+		check    func(c *PoolConfig) bool
+		err      bool
+	}{
+		{"none", map[string]string{}, func(c *PoolConfig) bool { return reflect.DeepEqual(*c, base) }, false},
+		{"strategy", map[string]string{"strategy": StrategyRoundRobin},
+			func(c *PoolConfig) bool { return c.Strategy == StrategyRoundRobin }, false},
+		{"durations", map[string]string{"blocked_clean_period": "5m", "cooldown": "250ms"},
+			func(c *PoolConfig) bool {
+				return c.BlockedCleanPeriod == 5*time.Minute && c.Cooldown == 250*time.Millisecond
+			}, false},
+		{"numbers", map[string]string{"concurrency": "3", "min_anonymity": "2"},
+			func(c *PoolConfig) bool { return c.Concurrency == 3 && c.MinAnonymity == 2 }, false},
+		{"list", map[string]string{"protocols": "https,socks5"},
+			func(c *PoolConfig) bool { return reflect.DeepEqual(c.Protocols, []string{"https", "socks5"}) }, false},
+		{"unknown", map[string]string{"colour": "blue"}, nil, true},
+		{"not a channel setting", map[string]string{"lease_ttl": "1m"}, nil, true},
+		{"unparsable", map[string]string{"cooldown": "soon"}, nil, true},
+		{"unknown strategy", map[string]string{"strategy": "luck"}, nil, true},
+		{"invalid concurrency", map[string]string{"concurrency": "0"}, nil, true},
+		{"invalid anonymity", map[string]string{"min_anonymity": "9"}, nil, true},
+		{"block shorter than max", map[string]string{"blocked_clean_period": "2h"}, nil, true},
+	}
+	for _, tt := range tests {
+		c, err := applySettings(base, tt.settings)
+		if tt.err {
+			if err == nil {
+				t.Errorf("%s: settings accepted", tt.name)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: %v", tt.name, err)
+			continue
+		}
+		if !tt.check(c) {
+			t.Errorf("%s: unexpected config %+v", tt.name, c)
+		}
+	}
+
+	// the base is left untouched
+	if _, err := applySettings(base, map[string]string{"protocols": "https"}); err != nil || base.Protocols != nil {
+		t.Errorf("base modified: %v %v", err, base.Protocols)
+	}
+}
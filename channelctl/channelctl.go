@@ -0,0 +1,84 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+
+	"github.com/seaguest/log"
+	"github.com/seaguest/proxypool"
+)
+
+const usage = `usage: channelctl [-config file] -channel name command
+commands:
+  get                   print the settings of the channel
+  set name=value ...    store settings, applied live by every process of the channel
+  reset [name ...]      remove settings, all of them if none is given
+settings: strategy, blocked_clean_period, concurrency, cooldown, min_anonymity, protocols
+`
+
+// tune the settings of a channel stored in redis, without restarting its processes.
+// the configuration must be the one of the processes of the channel, the settings are validated against it.
+func main() {
+	path := flag.String("config", "", "yaml or json config file of the channel processes")
+	channel := flag.String("channel", "", "channel name")
+	flag.Usage = func() {
+		fmt.Fprint(os.Stderr, usage)
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+
+	if *channel == "" || flag.NArg() == 0 {
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	conf, err := proxypool.LoadConfig(*path)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	if err := conf.LoadEnv(); err != nil {
+		log.Fatal(err)
+	}
+
+	args := flag.Args()[1:]
+	switch flag.Arg(0) {
+	case "get":
+		settings, err := proxypool.GetChannelSettings(conf, *channel)
+		if err != nil {
+			log.Fatal(err)
+		}
+
+		var names []string
+		for name := range settings {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			fmt.Printf("%s=%s\n", name, settings[name])
+		}
+	case "set":
+		settings := make(map[string]string)
+		for _, arg := range args {
+			sps := strings.SplitN(arg, "=", 2)
+			if len(sps) != 2 {
+				log.Fatalf("invalid setting [%s], expected name=value", arg)
+			}
+			settings[sps[0]] = sps[1]
+		}
+
+		if err := proxypool.SetChannelSettings(conf, *channel, settings); err != nil {
+			log.Fatal(err)
+		}
+	case "reset":
+		if err := proxypool.ResetChannelSettings(conf, *channel, args...); err != nil {
+			log.Fatal(err)
+		}
+	default:
+		flag.Usage()
+		os.Exit(2)
+	}
+}
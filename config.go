@@ -0,0 +1,457 @@
+package proxypool
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v2"
+)
+
+const envPrefix = "PROXYPOOL"
+
+// Config holds every tunable of the proxy center, the validation workers and the proxy pools.
+// it can be loaded from a yaml or json file, and overridden by environment variables.
+type Config struct {
+	// prefix prepended to every redis key, allows several deployments on one redis
+	KeyPrefix string `yaml:"key_prefix" json:"key_prefix"`
+
+	Redis  RedisConfig  `yaml:"redis" json:"redis"`
+	Center CenterConfig `yaml:"center" json:"center"`
+	Worker WorkerConfig `yaml:"worker" json:"worker"`
+	Pool   PoolConfig   `yaml:"pool" json:"pool"`
+}
+
+type RedisConfig struct {
+	Addr        string        `yaml:"addr" json:"addr"`
+	Password    string        `yaml:"password" json:"password"`
+	MaxIdle     int           `yaml:"max_idle" json:"max_idle"`
+	MaxActive   int           `yaml:"max_active" json:"max_active"` // 0 for unlimited
+	IdleTimeout time.Duration `yaml:"idle_timeout" json:"idle_timeout"`
+}
+
+type CenterConfig struct {
+	// proxies validated longer than this are revalidated
+	ValidationPeriod time.Duration `yaml:"validation_period" json:"validation_period"`
+
+	// period to fetch proxies from providers
+	LoadPeriod time.Duration `yaml:"load_period" json:"load_period"`
+
+	// how long an invalid proxy stays blocked
+	BlockedCleanPeriod time.Duration `yaml:"blocked_clean_period" json:"blocked_clean_period"`
+
+	// local cache ttl of the proxy list and blocked list
+	ProxyCacheTTL time.Duration `yaml:"proxy_cache_ttl" json:"proxy_cache_ttl"`
+	BlockCacheTTL time.Duration `yaml:"block_cache_ttl" json:"block_cache_ttl"`
+
+	// names of the providers to fetch from
+	Providers []string `yaml:"providers" json:"providers"`
+
+	// run a validation worker inside the center, disable it when standalone workers are deployed
+	RunWorker bool `yaml:"run_worker" json:"run_worker"`
+
+	// leader lease ttl, and the period to acquire or renew it
+	LeaderLeaseTTL    time.Duration `yaml:"leader_lease_ttl" json:"leader_lease_ttl"`
+	LeaderRenewPeriod time.Duration `yaml:"leader_renew_period" json:"leader_renew_period"`
+}
+
+type WorkerConfig struct {
+	// max routine for validation
+	MaxRoutine int `yaml:"max_routine" json:"max_routine"`
+
+	// judge url and timeout used to validate a proxy
+	ValidationURL     string        `yaml:"validation_url" json:"validation_url"`
+	ValidationTimeout time.Duration `yaml:"validation_timeout" json:"validation_timeout"`
+
+	// https url to check CONNECT support, empty to skip
+	ValidationHTTPSURL string `yaml:"validation_https_url" json:"validation_https_url"`
+
+	// entries read from the queue at once
+	BatchSize int `yaml:"batch_size" json:"batch_size"`
+
+	// pending entries idle longer than ClaimIdle are retried, at most MaxDelivery times
+	ClaimIdle   time.Duration `yaml:"claim_idle" json:"claim_idle"`
+	ClaimPeriod time.Duration `yaml:"claim_period" json:"claim_period"`
+	MaxDelivery int           `yaml:"max_delivery" json:"max_delivery"`
+}
+
+type PoolConfig struct {
+	// how long a proxy deleted by the channel stays blocked, and the first block of a proxy
+	// reported with StrikeLimit hard failures in a row, doubled for each block after up to MaxBlockPeriod.
+	BlockedCleanPeriod time.Duration `yaml:"blocked_clean_period" json:"blocked_clean_period"`
+	StrikeLimit        int           `yaml:"strike_limit" json:"strike_limit"`
+	MaxBlockPeriod     time.Duration `yaml:"max_block_period" json:"max_block_period"`
+
+	// period to check the channel proxies against the proxy center, a safety net for missed events
+	ValidationPeriod time.Duration `yaml:"validation_period" json:"validation_period"`
+
+	// local cache ttl of the blocked list
+	BlockCacheTTL time.Duration `yaml:"block_cache_ttl" json:"block_cache_ttl"`
+
+	// a proxy taken and not freed or deleted within LeaseTTL is reclaimed,
+	// its score increased by ReclaimPenalty.
+	LeaseTTL       time.Duration `yaml:"lease_ttl" json:"lease_ttl"`
+	ReapPeriod     time.Duration `yaml:"reap_period" json:"reap_period"`
+	ReclaimPenalty int           `yaml:"reclaim_penalty" json:"reclaim_penalty"`
+
+	// max concurrent leases of a proxy in the channel, overridden by the proxy metadata if set
+	Concurrency int `yaml:"concurrency" json:"concurrency"`
+
+	// max concurrent leases of a proxy across all the channels, shared fairly between them, 0 for no limit.
+	// it must be the same in every channel.
+	GlobalConcurrency int `yaml:"global_concurrency" json:"global_concurrency"`
+
+	// a freed proxy is not eligible again in the channel before Cooldown, 0 to disable
+	Cooldown time.Duration `yaml:"cooldown" json:"cooldown"`
+
+	// token bucket per proxy and target host, for the takes giving a Criteria.Host.
+	// TargetRate is in tokens per second, 0 to disable.
+	TargetRate  float64 `yaml:"target_rate" json:"target_rate"`
+	TargetBurst int     `yaml:"target_burst" json:"target_burst"`
+
+	// min proxies available or leased in the channel, checked every LowWaterPeriod, 0 to disable.
+	// below it, proxy center is asked to fetch at once and LowWater is emitted.
+	MinSize        int           `yaml:"min_size" json:"min_size"`
+	LowWaterPeriod time.Duration `yaml:"low_water_period" json:"low_water_period"`
+
+	// tunnel endpoint as ip:port, taken when the channel has no proxy available, empty for none
+	FallbackTunnel string `yaml:"fallback_tunnel" json:"fallback_tunnel"`
+
+	// how long a proxy banned by a target host is skipped for this host, in every channel
+	BurnTTL time.Duration `yaml:"burn_ttl" json:"burn_ttl"`
+
+	// a proxy with as many proxy-level failures reported by any channel since its last validation
+	// is skipped until revalidated, 0 to disable.
+	ProxyFailureLimit int `yaml:"proxy_failure_limit" json:"proxy_failure_limit"`
+
+	// requirements of every proxy taken in the channel, on top of the criteria of TakeWith
+	MinAnonymity int      `yaml:"min_anonymity" json:"min_anonymity"`
+	Protocols    []string `yaml:"protocols" json:"protocols"`
+
+	// selection strategy of the channel, see Strategy* constants
+	Strategy string `yaml:"strategy" json:"strategy"`
+
+	// StrategyBandit only: outcomes lose half their weight every BanditHalfLife,
+	// and a proxy is picked at random at BanditExploreRate, preferring the proxies barely seen.
+	BanditHalfLife    time.Duration `yaml:"bandit_half_life" json:"bandit_half_life"`
+	BanditExploreRate float64       `yaml:"bandit_explore_rate" json:"bandit_explore_rate"`
+
+	// avoid taking proxies of the same group in a row within DiversityWindow, see Diversity* constants, empty to disable.
+	// proxies of the same group are still taken when no other is available.
+	Diversity       string        `yaml:"diversity" json:"diversity"`
+	DiversityWindow time.Duration `yaml:"diversity_window" json:"diversity_window"`
+
+	// a subnet is blocked in channel for SubnetBlockPeriod once SubnetFailureLimit of its proxies
+	// had hard failures within SubnetFailureWindow, 0 to disable.
+	SubnetFailureLimit  int           `yaml:"subnet_failure_limit" json:"subnet_failure_limit"`
+	SubnetFailureWindow time.Duration `yaml:"subnet_failure_window" json:"subnet_failure_window"`
+	SubnetBlockPeriod   time.Duration `yaml:"subnet_block_period" json:"subnet_block_period"`
+
+	// max candidates checked against the strategy order and the criteria
+	SelectionScanLimit int `yaml:"selection_scan_limit" json:"selection_scan_limit"`
+
+	// proxies leased ahead of time by Take in a local buffer, in one script, 0 to disable.
+	// they are not available to the other processes meanwhile, and are returned unused on Close or after half their LeaseTTL.
+	Prefetch int `yaml:"prefetch" json:"prefetch"`
+
+	// period at which the first waiter of TakeContext reloads the channel and retries
+	WaitRetryPeriod time.Duration `yaml:"wait_retry_period" json:"wait_retry_period"`
+}
+
+// the configuration with every default value set.
+func DefaultConfig() *Config {
+	c := &Config{}
+	c.Redis = RedisConfig{
+		Addr:        "127.0.0.1:6379",
+		MaxIdle:     defaultRedisMaxIdle,
+		IdleTimeout: defaultRedisIdleTimeout,
+	}
+	c.Center = CenterConfig{
+		ValidationPeriod:   defaultCenterValidationPeriod,
+		LoadPeriod:         defaultLoadPeriod,
+		BlockedCleanPeriod: defaultBlockedCleanPeriod,
+		ProxyCacheTTL:      defaultProxyCacheTTL,
+		BlockCacheTTL:      defaultBlockCacheTTL,
+		Providers:          []string{"kuai"},
+		RunWorker:          true,
+		LeaderLeaseTTL:     defaultLeaderLeaseTTL,
+		LeaderRenewPeriod:  defaultLeaderRenew,
+	}
+	c.Worker = WorkerConfig{
+		MaxRoutine:        defaultMaxRoutine,
+		ValidationURL:     validationUrl,
+		ValidationTimeout: validationTimeout,
+		BatchSize:         defaultWorkerBatchSize,
+		ClaimIdle:         defaultWorkerClaimIdle,
+		ClaimPeriod:       defaultWorkerClaimPeriod,
+		MaxDelivery:       defaultWorkerMaxDelivery,
+	}
+	c.Pool = PoolConfig{
+		BlockedCleanPeriod:  defaultPoolBlockedCleanPeriod,
+		StrikeLimit:         defaultStrikeLimit,
+		MaxBlockPeriod:      defaultMaxBlockPeriod,
+		ValidationPeriod:    defaultValidationPeriod,
+		BlockCacheTTL:       blockCacheTTL,
+		LeaseTTL:            defaultLeaseTTL,
+		ReapPeriod:          defaultLeaseReapPeriod,
+		Concurrency:         defaultConcurrency,
+		TargetBurst:         defaultTargetBurst,
+		LowWaterPeriod:      defaultLowWaterPeriod,
+		BurnTTL:             defaultBurnTTL,
+		ProxyFailureLimit:   defaultProxyFailureLimit,
+		BanditHalfLife:      defaultBanditHalfLife,
+		BanditExploreRate:   defaultBanditExploreRate,
+		Strategy:            StrategyMostUsed,
+		DiversityWindow:     defaultDiversityWindow,
+		SubnetFailureWindow: defaultSubnetFailureWindow,
+		SubnetBlockPeriod:   defaultSubnetBlockPeriod,
+		SelectionScanLimit:  defaultSelectionScanLimit,
+		WaitRetryPeriod:     defaultWaitRetryPeriod,
+	}
+	return c
+}
+
+// load the configuration from a yaml or json file, on top of the default values.
+// an empty path returns the default configuration.
+func LoadConfig(path string) (*Config, error) {
+	c := DefaultConfig()
+	if path == "" {
+		return c, nil
+	}
+
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	// json is parsed as yaml, so that durations can be written as "10s" in both.
+	if err := yaml.Unmarshal(data, c); err != nil {
+		return nil, fmt.Errorf("parse config [%s]: %v", path, err)
+	}
+	return c, nil
+}
+
+// override the configuration with environment variables, named after the yaml keys,
+// e.g. PROXYPOOL_REDIS_ADDR, PROXYPOOL_WORKER_MAX_ROUTINE, PROXYPOOL_CENTER_PROVIDERS=kuai,data5u
+func (c *Config) LoadEnv() error {
+	return loadEnv(reflect.ValueOf(c).Elem(), envPrefix)
+}
+
+func loadEnv(v reflect.Value, prefix string) error {
+	t := v.Type()
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		tag := strings.Split(field.Tag.Get("yaml"), ",")[0]
+		if tag == "" || tag == "-" {
+			continue
+		}
+		name := prefix + "_" + strings.ToUpper(tag)
+
+		fv := v.Field(i)
+		if fv.Kind() == reflect.Struct {
+			if err := loadEnv(fv, name); err != nil {
+				return err
+			}
+			continue
+		}
+
+		s, found := os.LookupEnv(name)
+		if !found {
+			continue
+		}
+		if err := setField(fv, s); err != nil {
+			return fmt.Errorf("invalid env [%s=%s]: %v", name, s, err)
+		}
+	}
+	return nil
+}
+
+func setField(v reflect.Value, s string) error {
+	if v.Type() == reflect.TypeOf(time.Duration(0)) {
+		d, err := time.ParseDuration(s)
+		if err != nil {
+			return err
+		}
+		v.SetInt(int64(d))
+		return nil
+	}
+
+	switch v.Kind() {
+	case reflect.String:
+		v.SetString(s)
+	case reflect.Int, reflect.Int64:
+		n, err := strconv.ParseInt(s, 10, 64)
+		if err != nil {
+			return err
+		}
+		v.SetInt(n)
+	case reflect.Float64:
+		f, err := strconv.ParseFloat(s, 64)
+		if err != nil {
+			return err
+		}
+		v.SetFloat(f)
+	case reflect.Bool:
+		b, err := strconv.ParseBool(s)
+		if err != nil {
+			return err
+		}
+		v.SetBool(b)
+	case reflect.Slice:
+		if v.Type().Elem().Kind() != reflect.String {
+			return fmt.Errorf("unsupported type [%s]", v.Type())
+		}
+		var items []string
+		for _, item := range strings.Split(s, ",") {
+			if item = strings.TrimSpace(item); item != "" {
+				items = append(items, item)
+			}
+		}
+		v.Set(reflect.ValueOf(items))
+	default:
+		return fmt.Errorf("unsupported type [%s]", v.Type())
+	}
+	return nil
+}
+
+// check every value of the configuration.
+func (c *Config) Validate() error {
+	if err := c.Redis.Validate(); err != nil {
+		return err
+	}
+	if err := c.Center.Validate(); err != nil {
+		return err
+	}
+	if err := c.Worker.Validate(); err != nil {
+		return err
+	}
+	return c.Pool.Validate()
+}
+
+func (c *RedisConfig) Validate() error {
+	if c.Addr == "" {
+		return errors.New("redis addr is required")
+	}
+	if c.MaxIdle < 0 || c.MaxActive < 0 {
+		return errors.New("redis pool size must not be negative")
+	}
+	if c.MaxActive > 0 && c.MaxIdle > c.MaxActive {
+		return fmt.Errorf("redis max_idle [%d] exceeds max_active [%d]", c.MaxIdle, c.MaxActive)
+	}
+	if c.IdleTimeout < 0 {
+		return errors.New("redis idle_timeout must not be negative")
+	}
+	return nil
+}
+
+func (c *CenterConfig) Validate() error {
+	if err := positive(map[string]time.Duration{
+		"center validation_period":    c.ValidationPeriod,
+		"center load_period":          c.LoadPeriod,
+		"center blocked_clean_period": c.BlockedCleanPeriod,
+		"center proxy_cache_ttl":      c.ProxyCacheTTL,
+		"center block_cache_ttl":      c.BlockCacheTTL,
+		"center leader_lease_ttl":     c.LeaderLeaseTTL,
+		"center leader_renew_period":  c.LeaderRenewPeriod,
+	}); err != nil {
+		return err
+	}
+	if c.LeaderRenewPeriod >= c.LeaderLeaseTTL {
+		return fmt.Errorf("center leader_renew_period [%s] must be shorter than leader_lease_ttl [%s]", c.LeaderRenewPeriod, c.LeaderLeaseTTL)
+	}
+	return nil
+}
+
+func (c *WorkerConfig) Validate() error {
+	if c.MaxRoutine <= 0 || c.BatchSize <= 0 || c.MaxDelivery <= 0 {
+		return errors.New("worker max_routine, batch_size and max_delivery must be positive")
+	}
+	if u, err := url.Parse(c.ValidationURL); err != nil || u.Host == "" {
+		return fmt.Errorf("invalid worker validation_url [%s]", c.ValidationURL)
+	}
+	if c.ValidationHTTPSURL != "" {
+		if u, err := url.Parse(c.ValidationHTTPSURL); err != nil || u.Scheme != "https" || u.Host == "" {
+			return fmt.Errorf("invalid worker validation_https_url [%s]", c.ValidationHTTPSURL)
+		}
+	}
+	if err := positive(map[string]time.Duration{
+		"worker validation_timeout": c.ValidationTimeout,
+		"worker claim_idle":         c.ClaimIdle,
+		"worker claim_period":       c.ClaimPeriod,
+	}); err != nil {
+		return err
+	}
+	if c.ClaimIdle <= c.ValidationTimeout {
+		return fmt.Errorf("worker claim_idle [%s] must be longer than validation_timeout [%s]", c.ClaimIdle, c.ValidationTimeout)
+	}
+	return nil
+}
+
+func (c *PoolConfig) Validate() error {
+	if c.ReclaimPenalty < 0 {
+		return errors.New("pool reclaim_penalty must not be negative")
+	}
+	if c.StrikeLimit <= 0 {
+		return errors.New("pool strike_limit must be positive")
+	}
+	if c.MaxBlockPeriod < c.BlockedCleanPeriod {
+		return fmt.Errorf("pool max_block_period [%s] must not be shorter than blocked_clean_period [%s]", c.MaxBlockPeriod, c.BlockedCleanPeriod)
+	}
+	if c.Concurrency <= 0 {
+		return errors.New("pool concurrency must be positive")
+	}
+	if c.ProxyFailureLimit < 0 {
+		return errors.New("pool proxy_failure_limit must not be negative")
+	}
+	if c.GlobalConcurrency < 0 {
+		return errors.New("pool global_concurrency must not be negative")
+	}
+	if c.MinAnonymity < 0 || c.MinAnonymity > AnonymityHigh {
+		return fmt.Errorf("pool min_anonymity must be within 0 and %d", AnonymityHigh)
+	}
+	if c.SelectionScanLimit <= 0 {
+		return errors.New("pool selection_scan_limit must be positive")
+	}
+	if err := validStrategy(c.Strategy); err != nil {
+		return err
+	}
+	if err := validRateLimit(c); err != nil {
+		return err
+	}
+	if err := validLowWater(c); err != nil {
+		return err
+	}
+	if err := validBandit(c); err != nil {
+		return err
+	}
+	if err := validDiversity(c); err != nil {
+		return err
+	}
+	if err := validPrefetch(c); err != nil {
+		return err
+	}
+	return positive(map[string]time.Duration{
+		"pool blocked_clean_period": c.BlockedCleanPeriod,
+		"pool validation_period":    c.ValidationPeriod,
+		"pool block_cache_ttl":      c.BlockCacheTTL,
+		"pool lease_ttl":            c.LeaseTTL,
+		"pool reap_period":          c.ReapPeriod,
+		"pool wait_retry_period":    c.WaitRetryPeriod,
+		"pool burn_ttl":             c.BurnTTL,
+	})
+}
+
+func positive(durations map[string]time.Duration) error {
+	for name, d := range durations {
+		if d <= 0 {
+			return fmt.Errorf("%s must be positive, got [%s]", name, d)
+		}
+	}
+	return nil
+}
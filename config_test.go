@@ -0,0 +1,104 @@
+package proxypool
+
+import (
+	"os"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestSetField(t *testing.T) {
+	var v struct {
+		D time.Duration
+		S string
+		I int
+		F float64
+		B bool
+		L []string
+		M map[string]string
+	}
+	rv := reflect.ValueOf(&v).Elem()
+
+	tests := []struct {
+		field string
+		in    string
+		want  interface{}
+		err   bool
+	}{
+		{"D", "90s", 90 * time.Second, false},
+		{"D", "1h30m", 90 * time.Minute, false},
+		{"D", "90", nil, true},
+		{"S", "most_used", "most_used", false},
+		{"I", "42", 42, false},
+		{"I", "-3", -3, false},
+		{"I", "4.2", nil, true},
+		{"F", "0.25", 0.25, false},
+		{"F", "x", nil, true},
+		{"B", "true", true, false},
+		{"B", "0", false, false},
+		{"B", "yes", nil, true},
+		{"L", "https, socks5,,", []string{"https", "socks5"}, false},
+		{"L", "", []string(nil), false},
+		{"M", "a=b", nil, true},
+	}
+	for _, tt := range tests {
+		fv := rv.FieldByName(tt.field)
+		err := setField(fv, tt.in)
+		if tt.err {
+			if err == nil {
+				t.Errorf("setField(%s, %q) = nil, want an error", tt.field, tt.in)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("setField(%s, %q) = %v", tt.field, tt.in, err)
+			continue
+		}
+		if got := fv.Interface(); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("setField(%s, %q) set %#v, want %#v", tt.field, tt.in, got, tt.want)
+		}
+	}
+}
+
+func TestLoadEnv(t *testing.T) {
+	env := map[string]string{
+		"PROXYPOOL_KEY_PREFIX":               "test_",
+		"PROXYPOOL_REDIS_ADDR":               "10.0.0.1:6379",
+		"PROXYPOOL_WORKER_MAX_ROUTINE":       "7",
+		"PROXYPOOL_POOL_COOLDOWN":            "2s",
+		"PROXYPOOL_POOL_PROTOCOLS":           "https,socks5",
+		"PROXYPOOL_CENTER_RUN_WORKER":        "false",
+		"PROXYPOOL_POOL_BANDIT_EXPLORE_RATE": "0.5",
+	}
+	for k, v := range env {
+		os.Setenv(k, v)
+		defer os.Unsetenv(k)
+	}
+
+	c := DefaultConfig()
+	if err := c.LoadEnv(); err != nil {
+		t.Fatal(err)
+	}
+
+	if c.KeyPrefix != "test_" || c.Redis.Addr != "10.0.0.1:6379" || c.Worker.MaxRoutine != 7 {
+		t.Errorf("scalars not loaded: %q %q %d", c.KeyPrefix, c.Redis.Addr, c.Worker.MaxRoutine)
+	}
+	if c.Pool.Cooldown != 2*time.Second {
+		t.Errorf("cooldown = %s, want 2s", c.Pool.Cooldown)
+	}
+	if !reflect.DeepEqual(c.Pool.Protocols, []string{"https", "socks5"}) {
+		t.Errorf("protocols = %v", c.Pool.Protocols)
+	}
+	if c.Center.RunWorker {
+		t.Error("run_worker not loaded")
+	}
+	if c.Pool.BanditExploreRate != 0.5 {
+		t.Errorf("bandit_explore_rate = %v, want 0.5", c.Pool.BanditExploreRate)
+	}
+
+	os.Setenv("PROXYPOOL_POOL_CONCURRENCY", "many")
+	defer os.Unsetenv("PROXYPOOL_POOL_CONCURRENCY")
+	if err := DefaultConfig().LoadEnv(); err == nil {
+		t.Error("invalid env accepted")
+	}
+}
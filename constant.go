@@ -5,9 +5,49 @@ import "time"
 const (
 	/****************** redis prefix setting ******************/
 	proxyPrefix            = "proxy_"
+	proxyIndexKey          = "proxyindex" // not under proxy_ so that KEYS proxy_* of older clients skip it
+	proxyRttKey            = "proxyrtt"
+	proxyLeasePrefix       = "proxylease_" // leases of a proxy by channel, not under proxy_ either
+	proxyBurnPrefix        = "proxyburn_"  // proxies banned by a target host, across channels
 	proxyBlockedSet        = "proxy_blocked"
 	proxyPoolPrefix        = "proxypool_"
 	proxyPoolBlockedPrefix = "proxypool_blocked_"
+	proxyPoolLeasePrefix   = "proxypool_lease_"
+	proxyPoolLeaseInfo     = "proxypool_leaseinfo_"
+	proxyPoolLeasedPrefix  = "proxypool_leased_"
+	proxyPoolLeaseSeq      = "proxypool_leaseseq_"
+	proxyPoolRoundRobin    = "proxypool_rr_"
+	proxyPoolRttPrefix     = "proxypool_rtt_"
+	proxyPoolHealthPrefix  = "proxypool_health_"
+	proxyPoolWaitersPrefix = "proxypool_waiters_"
+	proxyPoolCooldownKey   = "proxypool_cooldown_"
+	proxyPoolBucketPrefix  = "proxypool_bucket_"
+	proxyPoolSessionPrefix = "proxypool_session_"
+	proxyPoolStrikesPrefix = "proxypool_strikes_"
+	proxyPoolOffencePrefix = "proxypool_offences_"
+	proxyPoolRefillLock    = "proxypool_refill_"
+	proxyPoolBanditPrefix  = "proxypool_bandit_"
+	proxyPoolWakePrefix    = "proxypool_wake_"
+	proxyPoolAlivePrefix   = "proxypool_alive_"
+	proxyPoolRecentPrefix  = "proxypool_recent_"
+	proxyPoolSubnetFailure = "proxypool_subnetfail_"
+	proxyPoolSubnetBlocked = "proxypool_subnetblocked_"
+	proxyPoolConfigPrefix  = "proxypool_conf_"
+
+	/****************** validation queue setting ******************/
+	proxyValidationStream = "proxy_validation"
+	proxyValidationGroup  = "proxy_validator"
+	proxyValidatingSet    = "proxy_validating"
+
+	/****************** pub/sub channel of proxy center changes ******************/
+	proxyEventChannel = "proxy_events"
+
+	/****************** low water setting ******************/
+	proxyFetchDemandKey = "proxy_fetch_demand"
+
+	/****************** leader election setting ******************/
+	proxyLeaderKey  = "proxy_center_leader"
+	proxyFencingKey = "proxy_center_fencing"
 
 	/****************** proxy request timeout ******************/
 	DefaultTimeout = 10000
@@ -0,0 +1,63 @@
+package proxypool
+
+import "github.com/seaguest/log"
+
+// Criteria a proxy must match to be taken by TakeWith, zero values match anything.
+type Criteria struct {
+	// minimal anonymity level, AnonymityTransparent to AnonymityHigh
+	MinAnonymity int
+
+	// max rtt measured by validation, in milliseconds
+	MaxRtt int
+
+	// protocols the proxy must support, e.g. https, socks5
+	Protocols []string
+
+	Country string
+	Region  string
+
+	// labels the proxy must all have
+	Labels []string
+
+	// target host the proxy is taken for, rate limited per proxy when the channel sets TargetRate,
+	// the proxies burnt for the host by any channel are skipped
+	Host string
+}
+
+// take a proxy for the target host, skipping the proxies burnt for it, see TakeWith.
+func (p *ProxyPool) TakeFor(host string) *Member {
+	return p.TakeWith(&Criteria{Host: host})
+}
+
+// take the best proxy matching the criteria, it is leased and must be settled with Free or Delete like Take.
+// only the first SelectionScanLimit proxies in the strategy order are checked, nil if none matches.
+// a nil criteria matches any proxy, and falls back to the FallbackTunnel of the channel if none is available.
+func (p *ProxyPool) TakeWith(criteria *Criteria) *Member {
+	proxy, err := p.selectLease(criteria)
+	if err != nil {
+		log.Error(err)
+		return nil
+	}
+
+	// if no proxy available, reload
+	if proxy == nil {
+		p.reload()
+
+		// retry
+		proxy, err = p.selectLease(criteria)
+		if err != nil {
+			log.Error(err)
+			return nil
+		}
+	}
+
+	// the fallback tunnel has no known attributes, it only serves takes without criteria
+	if proxy == nil && criteria == nil {
+		return p.borrowTunnel()
+	}
+
+	if proxy != nil && criteria != nil {
+		proxy.Host = criteria.Host
+	}
+	return proxy
+}
@@ -0,0 +1,157 @@
+package proxypool
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"time"
+
+	"github.com/garyburd/redigo/redis"
+	"github.com/seaguest/log"
+)
+
+// diversity modes of a channel, the proxy hash field grouping the proxies
+const (
+	// proxies of the same /24, or /48 for IPv6
+	DiversitySubnet = "subnet"
+
+	// proxies of the same autonomous system, set by SetProxyMeta
+	DiversityASN = "asn"
+)
+
+const (
+	defaultDiversityWindow     = time.Second * 10 // in seconds
+	defaultSubnetFailureWindow = time.Minute * 10 // in minutes
+	defaultSubnetBlockPeriod   = time.Minute * 30 // in minutes
+)
+
+// diversity of the members taken in a row, and the blocks of whole subnets.
+// a group taken within the window is skipped, unless relaxed once no other group is left.
+// KEYS: 11 recent groups, 12 blocked subnets; ARGV: 2 proxy key prefix, 18 now in milliseconds,
+// 25 diversity field or empty, 26 window in milliseconds, 27 subnet blocks enabled
+const diversityLua = `
+	local relaxed = false
+
+	local function groups(member)
+	    local f = redis.call('HMGET', ARGV[2] .. member, 'subnet', ARGV[25] ~= '' and ARGV[25] or 'subnet')
+	    local g = f[2]
+	    if ARGV[25] == '' or g == false or g == '' or g == '0' then
+	        g = nil
+	    end
+	    return f[1] or nil, g
+	end
+
+	local function diverse(member)
+	    if ARGV[25] == '' and ARGV[27] == '0' then
+	        return true
+	    end
+	    local subnet, g = groups(member)
+	    if ARGV[27] == '1' and subnet then
+	        local ends = redis.call('ZSCORE', KEYS[12], subnet)
+	        if ends and tonumber(ends) > tonumber(ARGV[18]) then
+	            return false
+	        end
+	    end
+	    if relaxed or not g then
+	        return true
+	    end
+	    local last = redis.call('ZSCORE', KEYS[11], g)
+	    return not last or tonumber(last) + tonumber(ARGV[26]) <= tonumber(ARGV[18])
+	end
+
+	-- remember the group of the member taken, and forget the groups out of the window
+	local function remember(member)
+	    if ARGV[25] == '' then
+	        return
+	    end
+	    local _, g = groups(member)
+	    if g then
+	        local now = tonumber(ARGV[18])
+	        redis.call('ZADD', KEYS[11], now, g)
+	        redis.call('ZREMRANGEBYSCORE', KEYS[11], '-inf', now - tonumber(ARGV[26]))
+	    end
+	end
+`
+
+// subnet of the ip, /24 for IPv4 and /48 for IPv6, empty if not an ip.
+func subnetOf(ip string) string {
+	parsed := net.ParseIP(ip)
+	if parsed == nil {
+		return ""
+	}
+
+	mask := net.CIDRMask(48, 128)
+	if v4 := parsed.To4(); v4 != nil {
+		parsed, mask = v4, net.CIDRMask(24, 32)
+	}
+	return (&net.IPNet{IP: parsed.Mask(mask), Mask: mask}).String()
+}
+
+// count a hard failure of the member in its subnet, and block the subnet in channel
+// once enough distinct members of it failed within the window.
+// return the subnet blocked, or an empty string.
+// KEYS: 1 blocked subnets; ARGV: 1 proxy hash, 2 failure key prefix, 3 member, 4 now in milliseconds,
+// 5 window in milliseconds, 6 failure limit, 7 block period in milliseconds
+var subnetFailureScript = redis.NewScript(1, `
+	local subnet = redis.call('HGET', ARGV[1], 'subnet')
+	if not subnet or subnet == '' then
+	    return ''
+	end
+	local now = tonumber(ARGV[4])
+	local key = ARGV[2] .. subnet
+	redis.call('ZADD', key, now, ARGV[3])
+	redis.call('ZREMRANGEBYSCORE', key, '-inf', now - tonumber(ARGV[5]))
+	redis.call('PEXPIRE', key, ARGV[5])
+	if redis.call('ZCARD', key) < tonumber(ARGV[6]) then
+	    return ''
+	end
+	redis.call('DEL', key)
+	redis.call('ZREMRANGEBYSCORE', KEYS[1], '-inf', now)
+	redis.call('ZADD', KEYS[1], now + tonumber(ARGV[7]), subnet)
+	return subnet`)
+
+// count a hard failure of the proxy against its subnet, see SubnetFailureLimit.
+func (p *ProxyPool) strikeSubnet(member string) {
+	if p.config().SubnetFailureLimit <= 0 {
+		return
+	}
+
+	c := p.pool.Get()
+	defer c.Close()
+
+	subnet, err := redis.String(subnetFailureScript.Do(c, p.strikeArgs(member)...))
+	if err != nil {
+		log.Error(err)
+		return
+	}
+	p.subnetBlocked(subnet)
+}
+
+func (p *ProxyPool) strikeArgs(member string) redis.Args {
+	return redis.Args{}.Add(p.keys.poolSubnetBlockedKey(p.channel), p.keys.proxyPrefix()+member,
+		p.keys.poolSubnetFailurePrefix(p.channel), member, p.nowMillis(), int64(p.config().SubnetFailureWindow/time.Millisecond),
+		p.config().SubnetFailureLimit, int64(p.config().SubnetBlockPeriod/time.Millisecond))
+}
+
+// log the subnet blocked by a strike, if any.
+func (p *ProxyPool) subnetBlocked(subnet string) {
+	if subnet != "" {
+		log.Errorf("subnet [%s] blocked in channel [%s] after [%d] proxies failed", subnet, p.channel, p.config().SubnetFailureLimit)
+	}
+}
+
+func validDiversity(c *PoolConfig) error {
+	switch c.Diversity {
+	case "", DiversitySubnet, DiversityASN:
+	default:
+		return fmt.Errorf("unknown pool diversity [%s]", c.Diversity)
+	}
+	if c.SubnetFailureLimit < 0 {
+		return errors.New("pool subnet_failure_limit must not be negative")
+	}
+	return positive(map[string]time.Duration{
+		"pool diversity_window":      c.DiversityWindow,
+		"pool subnet_failure_window": c.SubnetFailureWindow,
+		"pool subnet_block_period":   c.SubnetBlockPeriod,
+	})
+}
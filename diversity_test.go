@@ -0,0 +1,58 @@
+package proxypool
+
+import "testing"
+
+func TestSubnetOf(t *testing.T) {
+	tests := []struct {
+		ip   string
+		want string
+	}{
+		{"1.2.3.4", "1.2.3.0/24"},
+		{"10.0.0.255", "10.0.0.0/24"},
+		{"::ffff:1.2.3.4", "1.2.3.0/24"},
+		{"2001:db8:abcd:12::1", "2001:db8:abcd::/48"},
+		{"2001:db8::", "2001:db8::/48"},
+		{"", ""},
+		{"1.2.3", ""},
+		{"proxy.example.com", ""},
+	}
+	for _, tt := range tests {
+		if got := subnetOf(tt.ip); got != tt.want {
+			t.Errorf("subnetOf(%q) = %q, want %q", tt.ip, got, tt.want)
+		}
+	}
+}
+
+func TestStrikeSubnet(t *testing.T) {
+	pp := newTestPool(t, "subnet", func(c *Config) {
+		c.Pool.SubnetFailureLimit = 2
+	})
+	for _, member := range []string{"10.0.0.1:80", "10.0.0.2:80", "10.0.1.1:80", "[2001:db8::1]:80"} {
+		addTestProxy(t, pp, member, 10)
+	}
+
+	blocked := func() []string {
+		members, err := zrange(pp.keys.poolSubnetBlockedKey(pp.channel), pp.pool)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var subnets []string
+		for _, member := range members {
+			subnets = append(subnets, member.Member)
+		}
+		return subnets
+	}
+
+	// the same proxy twice, and proxies of other subnets, do not count
+	for _, member := range []string{"10.0.0.1:80", "10.0.0.1:80", "10.0.1.1:80", "[2001:db8::1]:80"} {
+		pp.strikeSubnet(member)
+	}
+	if subnets := blocked(); len(subnets) != 0 {
+		t.Fatalf("blocked %v", subnets)
+	}
+
+	pp.strikeSubnet("10.0.0.2:80")
+	if subnets := blocked(); len(subnets) != 1 || subnets[0] != "10.0.0.0/24" {
+		t.Fatalf("blocked %v, want 10.0.0.0/24", subnets)
+	}
+}
@@ -0,0 +1,137 @@
+package proxypool
+
+import (
+	"context"
+	"strings"
+	"time"
+
+	"github.com/garyburd/redigo/redis"
+	"github.com/seaguest/log"
+)
+
+// events published by proxy center, as type|ip:port, or config|channel when the settings of channel change
+const (
+	eventAdd    = "add"
+	eventUpdate = "update"
+	eventRemove = "remove"
+	eventConfig = "config"
+)
+
+// add a member of proxy center to channel unless blocked or leased, and wake up a waiter to take it.
+// the rtt of the member is refreshed in channel even if leased.
+// KEYS: 7 waiters, 8 blocked, 9 rtt; ARGV: 7 member, 8 now, 9 wake prefix, 10 alive prefix
+var addMemberScript = redis.NewScript(9, leaseLua+`
+	if redis.call('ZSCORE', KEYS[8], ARGV[7]) then
+	    return 0
+	end
+	local rtt = redis.call('HGET', ARGV[2] .. ARGV[7], 'rtt')
+	if rtt then
+	    redis.call('ZADD', KEYS[9], rtt, ARGV[7])
+	end
+	if redis.call('HGET', KEYS[4], ARGV[7]) then
+	    return 0
+	end
+	if redis.call('ZADD', KEYS[1], 'NX', 0, ARGV[7]) == 0 then
+	    return 0
+	end
+	-- new members come first in round robin
+	redis.call('ZADD', KEYS[6], 'NX', 0, ARGV[7])
+	handoff(KEYS[7], nil, 0, ARGV[8], ARGV[9], ARGV[10])
+	return 1`)
+
+// apply the events of proxy center to channel, reconciling after each reconnection since events may have been missed.
+func (p *ProxyPool) subscribe(ctx context.Context) {
+	for ctx.Err() == nil {
+		if err := p.receiveEvents(ctx); err != nil && ctx.Err() == nil {
+			log.Error(err)
+			sleep(ctx, time.Second)
+		}
+	}
+}
+
+func (p *ProxyPool) receiveEvents(ctx context.Context) error {
+	psc := redis.PubSubConn{Conn: p.pool.Get()}
+	defer psc.Close()
+
+	if err := psc.Subscribe(p.keys.eventChannel()); err != nil {
+		return err
+	}
+
+	// unsubscribe on ctx done, so that Receive returns
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		select {
+		case <-ctx.Done():
+			psc.Unsubscribe()
+		case <-done:
+		}
+	}()
+
+	for {
+		switch v := psc.Receive().(type) {
+		case redis.Message:
+			p.applyEvent(string(v.Data))
+		case redis.Subscription:
+			if v.Count == 0 {
+				return nil
+			}
+
+			// events may have been missed while not subscribed
+			if v.Kind == "subscribe" {
+				if err := p.checkProxies(); err != nil {
+					log.Error(err)
+				}
+				if err := p.loadSettings(); err != nil {
+					log.Error(err)
+				}
+			}
+		case error:
+			return v
+		}
+	}
+}
+
+func (p *ProxyPool) applyEvent(event string) {
+	sps := strings.SplitN(event, "|", 2)
+	if len(sps) != 2 {
+		log.Errorf("invalid proxy event [%s]", event)
+		return
+	}
+
+	member := sps[1]
+	switch sps[0] {
+	case eventAdd, eventUpdate:
+		if err := p.addMember(member); err != nil {
+			log.Error(err)
+		}
+	case eventRemove:
+		// leased proxies are blocked too, so that they are not freed back
+		if err := p.deleteLease(&Member{Member: member}); err != nil {
+			log.Error(err)
+		}
+	case eventConfig:
+		if member != p.channel {
+			return
+		}
+		if err := p.loadSettings(); err != nil {
+			log.Error(err)
+		}
+	default:
+		log.Errorf("invalid proxy event [%s]", event)
+	}
+}
+
+func (p *ProxyPool) addMember(member string) error {
+	c := p.pool.Get()
+	defer c.Close()
+
+	if err := c.Err(); err != nil {
+		return err
+	}
+
+	args := p.leaseArgs(p.keys.poolWaitersKey(p.channel), p.keys.poolBlockedKey(p.channel), p.keys.poolRttKey(p.channel)).
+		Add(member, p.nowMillis(), p.keys.poolWakePrefix(p.channel), p.keys.poolAlivePrefix(p.channel))
+	_, err := addMemberScript.Do(c, args...)
+	return err
+}
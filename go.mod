@@ -3,6 +3,7 @@ module github.com/seaguest/proxypool
 go 1.15
 
 require (
+	github.com/alicebob/miniredis/v2 v2.17.0
 	github.com/elazarl/goproxy v0.0.0-20211114080932-d06c3be7c11b
 	github.com/garyburd/redigo v1.6.3
 	github.com/gin-gonic/gin v1.7.7
@@ -10,4 +11,5 @@ require (
 	github.com/patrickmn/go-cache v2.1.0+incompatible
 	github.com/seaguest/common v1.0.5
 	github.com/seaguest/log v1.1.0
+	gopkg.in/yaml.v2 v2.2.8
 )
@@ -0,0 +1,181 @@
+package proxypool
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/garyburd/redigo/redis"
+	"github.com/seaguest/log"
+)
+
+const (
+	defaultLeaderLeaseTTL = time.Second * 15 // in seconds
+	defaultLeaderRenew    = time.Second * 5  // in seconds
+)
+
+var errNotLeader = errors.New("fencing token rejected, not the leader")
+
+// take the lease if free with a new fencing token, or renew it if still held by the token.
+var leaderScript = redis.NewScript(2, `
+	local current = redis.call('GET', KEYS[1])
+	if not current then
+	    local token = redis.call('INCR', KEYS[2])
+	    redis.call('SET', KEYS[1], token, 'PX', ARGV[2])
+	    return token
+	end
+	if current == ARGV[1] then
+	    redis.call('PEXPIRE', KEYS[1], ARGV[2])
+	    return tonumber(current)
+	end
+	return 0`)
+
+// release the lease only if still held by the token.
+var resignScript = redis.NewScript(1, `
+	if redis.call('GET', KEYS[1]) == ARGV[1] then
+	    return redis.call('DEL', KEYS[1])
+	end
+	return 0`)
+
+// remove member from sorted set only if the fencing token is still the current one.
+var fencedZremScript = redis.NewScript(2, `
+	if redis.call('GET', KEYS[2]) ~= ARGV[2] then
+	    return -1
+	end
+	return redis.call('ZREM', KEYS[1], ARGV[1])`)
+
+// leaderElector holds a lease in redis, only one ProxyCenter replica is the leader at a time.
+// a new leader takes over at most leaseTTL+renewPeriod after the current one dies.
+type leaderElector struct {
+	// redis pool
+	pool *redis.Pool
+
+	// redis keys
+	keys keyspace
+
+	// lease ttl in redis
+	leaseTTL time.Duration
+
+	// period to acquire or renew the lease
+	renewPeriod time.Duration
+
+	// fencing token of the lease held, 0 if not leader
+	token int64
+
+	// local deadline of the lease, renewed on success
+	leaseUntil time.Time
+
+	mu sync.RWMutex
+}
+
+func newLeaderElector(pool *redis.Pool, keys keyspace, leaseTTL, renewPeriod time.Duration) *leaderElector {
+	e := &leaderElector{}
+	e.pool = pool
+	e.keys = keys
+	e.leaseTTL = leaseTTL
+	e.renewPeriod = renewPeriod
+	return e
+}
+
+func (e *leaderElector) run(ctx context.Context) {
+	for {
+		e.campaign()
+		if !sleep(ctx, e.renewPeriod) {
+			return
+		}
+	}
+}
+
+func (e *leaderElector) campaign() {
+	start := time.Now()
+	current := e.fencingToken()
+
+	token, err := acquireLease(current, e.leaseTTL, e.keys, e.pool)
+	if err != nil {
+		// keep the local lease until it expires, redis may be back before that
+		log.Error(err)
+		return
+	}
+
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	if token == 0 {
+		if e.token != 0 {
+			log.Errorf("lost leadership, fencing token [%d]", e.token)
+		}
+		e.token = 0
+		return
+	}
+
+	if token != e.token {
+		log.Errorf("became leader, fencing token [%d]", token)
+	}
+	e.token = token
+	// count from the request start, the lease in redis can't expire earlier
+	e.leaseUntil = start.Add(e.leaseTTL)
+}
+
+// the fencing token if the lease is still valid locally, 0 otherwise.
+func (e *leaderElector) fencingToken() int64 {
+	e.mu.RLock()
+	defer e.mu.RUnlock()
+
+	if e.token == 0 || time.Now().After(e.leaseUntil) {
+		return 0
+	}
+	return e.token
+}
+
+func (e *leaderElector) isLeader() bool {
+	return e.fencingToken() != 0
+}
+
+// give up the lease so that another replica takes over immediately.
+func (e *leaderElector) resign() {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	if e.token == 0 {
+		return
+	}
+
+	c := e.pool.Get()
+	defer c.Close()
+
+	if _, err := resignScript.Do(c, e.keys.leaderKey(), e.token); err != nil {
+		log.Error(err)
+	}
+	e.token = 0
+}
+
+func acquireLease(token int64, ttl time.Duration, keys keyspace, pool *redis.Pool) (int64, error) {
+	c := pool.Get()
+	defer c.Close()
+
+	if err := c.Err(); err != nil {
+		return 0, err
+	}
+
+	return redis.Int64(leaderScript.Do(c, keys.leaderKey(), keys.fencingKey(), token, int64(ttl/time.Millisecond)))
+}
+
+func fencedZrem(key, member string, token int64, keys keyspace, pool *redis.Pool) error {
+	c := pool.Get()
+	defer c.Close()
+
+	if err := c.Err(); err != nil {
+		return err
+	}
+
+	ret, err := redis.Int(fencedZremScript.Do(c, key, keys.leaderKey(), member, token))
+	if err != nil {
+		return err
+	}
+
+	if ret < 0 {
+		return errNotLeader
+	}
+	return nil
+}
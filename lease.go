@@ -0,0 +1,385 @@
+package proxypool
+
+import (
+	"context"
+	"strconv"
+	"time"
+
+	"github.com/garyburd/redigo/redis"
+	"github.com/seaguest/log"
+)
+
+const (
+	defaultLeaseTTL        = time.Minute * 5  // in minutes
+	defaultLeaseReapPeriod = time.Second * 10 // in seconds
+	defaultLeaseReapBatch  = 100
+	defaultConcurrency     = 1
+	cooldownPoll           = time.Second          // in seconds, max wait between two cooldown passes
+	cooldownMinPoll        = time.Millisecond * 5 // in milliseconds
+)
+
+// lease helpers shared by the scripts of a channel.
+// KEYS: 1 pool, 2 lease, 3 leaseinfo, 4 leased, 5 leaseseq, 6 roundrobin;
+// ARGV: 1 deadline of new leases, 2 proxy key prefix, 3 concurrency of the channel,
+// 4 global concurrency, 0 for none, 5 global lease key prefix, 6 channel.
+const leaseLua = `
+	-- max concurrent leases of member, the proxy setting overrides the channel one.
+	local function concurrency(member)
+	    local n = tonumber(redis.call('HGET', ARGV[2] .. member, 'concurrency') or '0') or 0
+	    if n > 0 then
+	        return n
+	    end
+	    return tonumber(ARGV[3])
+	end
+
+	-- false if the leases of member across channels reached the global concurrency, or if channel holds its fair share:
+	-- the global concurrency split between the channels holding member, channel included.
+	local function shared(member)
+	    local cap = tonumber(ARGV[4])
+	    if cap <= 0 then
+	        return true
+	    end
+	    local counts = redis.call('HGETALL', ARGV[5] .. member)
+	    local total, n, mine = 0, 0, 0
+	    for i = 1, #counts, 2 do
+	        local count = tonumber(counts[i + 1])
+	        total = total + count
+	        n = n + 1
+	        if counts[i] == ARGV[6] then
+	            mine = count
+	        end
+	    end
+	    if total >= cap then
+	        return false
+	    end
+	    if mine == 0 then
+	        n = n + 1
+	    end
+	    return mine < math.ceil(cap / n)
+	end
+
+	-- true while the leases of member in channel are below its concurrency.
+	local function available(member)
+	    return tonumber(redis.call('HGET', KEYS[4], member) or '0') < concurrency(member)
+	end
+
+	-- lease a member of channel until the deadline, it leaves channel once leased up to its concurrency.
+	-- the lease id is member|seq, so that the member can be found from the lease alone.
+	local function lease(member, score)
+	    local seq = redis.call('INCR', KEYS[5])
+	    local id = member .. '|' .. seq
+	    redis.call('ZADD', KEYS[2], ARGV[1], id)
+	    redis.call('HSET', KEYS[3], id, score)
+	    if redis.call('HINCRBY', KEYS[4], member, 1) >= concurrency(member) then
+	        redis.call('ZREM', KEYS[1], member)
+	    end
+	    if tonumber(ARGV[4]) > 0 then
+	        redis.call('HINCRBY', ARGV[5] .. member, ARGV[6], 1)
+	    end
+	    redis.call('ZADD', KEYS[6], seq, member)
+	    return {member, score, id}
+	end
+
+	-- settle the lease, return the score of the member when leased, nil if already settled.
+	local function release(id, member)
+	    if redis.call('ZREM', KEYS[2], id) == 0 then
+	        return nil
+	    end
+	    local score = tonumber(redis.call('HGET', KEYS[3], id) or '0')
+	    redis.call('HDEL', KEYS[3], id)
+	    if redis.call('HINCRBY', KEYS[4], member, -1) <= 0 then
+	        redis.call('HDEL', KEYS[4], member)
+	    end
+	    if tonumber(ARGV[4]) > 0 and redis.call('HINCRBY', ARGV[5] .. member, ARGV[6], -1) <= 0 then
+	        redis.call('HDEL', ARGV[5] .. member, ARGV[6])
+	    end
+	    return score
+	end
+
+	-- add incr to the score of member, back in channel with its score when leased if it had left,
+	-- unless its other leases still hold it at its concurrency.
+	local function restore(member, score, incr)
+	    if redis.call('ZSCORE', KEYS[1], member) then
+	        redis.call('ZINCRBY', KEYS[1], incr, member)
+	    elseif available(member) then
+	        redis.call('ZADD', KEYS[1], score + incr, member)
+	    end
+	end
+
+	-- hand the member to the first live waiter with a new lease, or only wake it up when member is nil.
+	-- a waiter is proc|id|deadline, 0 for no deadline, the message is pushed to the wake list of its process.
+	-- a waiter with an id ending in * is only woken up, and member is left to the caller.
+	-- false if no waiter is left, or if member may not be leased again yet.
+	local function handoff(waiters, member, score, now, wakePrefix, alivePrefix)
+	    if member and not (available(member) and shared(member)) then
+	        return false
+	    end
+	    while true do
+	        local w = redis.call('LPOP', waiters)
+	        if not w then
+	            return false
+	        end
+	        local proc, id, deadline = string.match(w, '^(.-)|(.-)|(%d+)$')
+	        deadline = tonumber(deadline)
+	        if proc and (deadline == 0 or deadline > tonumber(now)) and redis.call('EXISTS', alivePrefix .. proc) == 1 then
+	            local msg = id
+	            local retry = string.sub(id, -1) == '*'
+	            if member and not retry then
+	                local r = lease(member, score)
+	                msg = id .. '|' .. r[2] .. '|' .. r[3]
+	            end
+	            redis.call('RPUSH', wakePrefix .. proc, msg)
+	            redis.call('EXPIRE', wakePrefix .. proc, 60)
+	            return not (member and retry)
+	        end
+	    end
+	end
+`
+
+// return a released member, with its score increased, to the first waiter or to channel, unless blocked meanwhile.
+// during the cooldown, the member is back in channel but not eligible, and not handed to waiters until it ends.
+// KEYS: 7 waiters, 8 blocked, 9 cooldown
+const settleLua = `
+	local function settle(member, score, incr, now, wakePrefix, alivePrefix, cooldown)
+	    if redis.call('ZSCORE', KEYS[8], member) then
+	        return
+	    end
+	    if tonumber(cooldown) > 0 then
+	        redis.call('ZADD', KEYS[9], tonumber(now) + tonumber(cooldown), member)
+	        restore(member, score, incr)
+	    elseif not handoff(KEYS[7], member, score + incr, now, wakePrefix, alivePrefix) then
+	        restore(member, score, incr)
+	    end
+	end
+`
+
+// settle the lease and return the proxy with its score increased, nothing is done if the lease has already been reclaimed.
+// KEYS: 7 waiters, 8 blocked, 9 cooldown; ARGV: 7 lease, 8 member, 9 incr, 10 now, 11 wake prefix, 12 alive prefix, 13 cooldown
+var freeScript = redis.NewScript(9, leaseLua+settleLua+`
+	local score = release(ARGV[7], ARGV[8])
+	if not score then
+	    return 0
+	end
+	settle(ARGV[8], score, tonumber(ARGV[9]), ARGV[10], ARGV[11], ARGV[12], ARGV[13])
+	return 1`)
+
+// settle the lease if any, and block the proxy in channel.
+// KEYS: 7 blocked; ARGV: 7 lease, 8 member, 9 end of the block in seconds
+var deleteScript = redis.NewScript(7, leaseLua+`
+	if ARGV[7] ~= '' then
+	    release(ARGV[7], ARGV[8])
+	end
+	redis.call('ZADD', KEYS[7], ARGV[9], ARGV[8])
+	redis.call('ZREM', KEYS[1], ARGV[8])
+	return 1`)
+
+// return the proxies of expired leases with the penalty added, to the first waiter or to channel, unless blocked meanwhile.
+// KEYS: 7 waiters, 8 blocked; ARGV: 7 now, 8 penalty, 9 batch, 10 wake prefix, 11 alive prefix
+var reapScript = redis.NewScript(8, leaseLua+`
+	local leases = redis.call('ZRANGEBYSCORE', KEYS[2], '-inf', ARGV[7], 'LIMIT', 0, ARGV[9])
+	for _, id in ipairs(leases) do
+	    local member = string.match(id, '^(.*)|')
+	    local score = release(id, member)
+	    if score and not redis.call('ZSCORE', KEYS[8], member) then
+	        if not handoff(KEYS[7], member, score + tonumber(ARGV[8]), ARGV[7], ARGV[10], ARGV[11]) then
+	            restore(member, score, tonumber(ARGV[8]))
+	        end
+	    end
+	end
+	return #leases`)
+
+// end the cooldowns passed, handing each member still in channel to the first waiters.
+// return the end of the next cooldown, 0 if none.
+// KEYS: 7 waiters, 8 cooldown; ARGV: 7 now, 8 wake prefix, 9 alive prefix
+var cooldownScript = redis.NewScript(8, leaseLua+`
+	for _, member in ipairs(redis.call('ZRANGEBYSCORE', KEYS[8], '-inf', ARGV[7])) do
+	    redis.call('ZREM', KEYS[8], member)
+	    local score = redis.call('ZSCORE', KEYS[1], member)
+	    if score then
+	        -- as many waiters as the concurrency of member allows
+	        while handoff(KEYS[7], member, tonumber(score), ARGV[7], ARGV[8], ARGV[9]) do
+	        end
+	    end
+	end
+	local next = redis.call('ZRANGE', KEYS[8], 0, 0, 'WITHSCORES')
+	if #next == 0 then
+	    return 0
+	end
+	return tonumber(next[2])`)
+
+// keys shared by the lease scripts, in the order of leaseLua
+func (p *ProxyPool) leaseKeys() []interface{} {
+	return []interface{}{
+		p.keys.poolKey(p.channel),
+		p.keys.poolLeaseKey(p.channel),
+		p.keys.poolLeaseInfoKey(p.channel),
+		p.keys.poolLeasedKey(p.channel),
+		p.keys.poolLeaseSeqKey(p.channel),
+		p.keys.poolRoundRobinKey(p.channel),
+	}
+}
+
+// keys and arguments shared by the lease scripts, followed by the extra keys of the script.
+func (p *ProxyPool) leaseArgs(keys ...interface{}) redis.Args {
+	return redis.Args{}.Add(p.leaseKeys()...).Add(keys...).
+		Add(p.leaseDeadline(), p.keys.proxyPrefix(), p.config().Concurrency, p.config().GlobalConcurrency, p.keys.globalLeasePrefix(), p.channel)
+}
+
+// end of a block starting now, for the blocked set scored by block end
+func (p *ProxyPool) blockEnd() int64 {
+	return p.now().Add(p.config().BlockedCleanPeriod).Unix()
+}
+
+// current time of channel, given to the scripts, only simulations replace the clock
+func (p *ProxyPool) now() time.Time {
+	return p.clock()
+}
+
+func (p *ProxyPool) nowMillis() int64 {
+	return p.now().UnixNano() / int64(time.Millisecond)
+}
+
+func (p *ProxyPool) leaseDeadline() int64 {
+	return p.nowMillis() + int64(p.config().LeaseTTL/time.Millisecond)
+}
+
+// parse the {member, score, lease} reply of take scripts, nil if empty
+func parseLease(reply interface{}, err error) (*Member, error) {
+	v, err := redis.Strings(reply, err)
+	if err != nil {
+		return nil, err
+	}
+
+	// return nil if no record found
+	if len(v) == 0 {
+		return nil, nil
+	}
+
+	var proxy Member
+	proxy.Member = v[0]
+	proxy.Score, _ = strconv.Atoi(v[1])
+	proxy.Lease = v[2]
+	return &proxy, nil
+}
+
+// parse the flat {member, score, lease, ...} reply of batch take scripts
+func parseLeases(reply interface{}, err error) ([]*Member, error) {
+	v, err := redis.Strings(reply, err)
+	if err != nil {
+		return nil, err
+	}
+
+	var proxies []*Member
+	for i := 0; i+2 < len(v); i += 3 {
+		proxy := &Member{Member: v[i], Lease: v[i+2]}
+		proxy.Score, _ = strconv.Atoi(v[i+1])
+		proxies = append(proxies, proxy)
+	}
+	return proxies, nil
+}
+
+// settle the lease and return the proxy, false if the lease expired and was reclaimed.
+func (p *ProxyPool) freeLease(proxy *Member, incr int) (bool, error) {
+	c := p.pool.Get()
+	defer c.Close()
+
+	if err := c.Err(); err != nil {
+		return false, err
+	}
+
+	args := p.leaseArgs(p.keys.poolWaitersKey(p.channel), p.keys.poolBlockedKey(p.channel), p.keys.poolCooldownKey(p.channel)).
+		Add(proxy.Lease, proxy.Member, incr, p.nowMillis(), p.keys.poolWakePrefix(p.channel), p.keys.poolAlivePrefix(p.channel),
+			int64(p.config().Cooldown/time.Millisecond))
+	return redis.Bool(freeScript.Do(c, args...))
+}
+
+// settle the lease if any, and block the proxy in channel.
+func (p *ProxyPool) deleteLease(proxy *Member) error {
+	c := p.pool.Get()
+	defer c.Close()
+
+	if err := c.Err(); err != nil {
+		return err
+	}
+
+	args := p.leaseArgs(p.keys.poolBlockedKey(p.channel)).Add(proxy.Lease, proxy.Member, p.blockEnd())
+	_, err := deleteScript.Do(c, args...)
+	return err
+}
+
+// reclaim the expired leases, return the number of leases reclaimed.
+func (p *ProxyPool) reapLeases() (int, error) {
+	c := p.pool.Get()
+	defer c.Close()
+
+	if err := c.Err(); err != nil {
+		return 0, err
+	}
+
+	args := p.leaseArgs(p.keys.poolWaitersKey(p.channel), p.keys.poolBlockedKey(p.channel)).
+		Add(p.nowMillis(), p.config().ReclaimPenalty, defaultLeaseReapBatch, p.keys.poolWakePrefix(p.channel), p.keys.poolAlivePrefix(p.channel))
+	return redis.Int(reapScript.Do(c, args...))
+}
+
+// return the proxies of abandoned leases to channel.
+func (p *ProxyPool) reap(ctx context.Context) {
+	for {
+		n, err := p.reapLeases()
+		if err != nil {
+			log.Error(err)
+		} else if n > 0 {
+			log.Errorf("reclaimed [%d] expired leases in channel [%s]", n, p.channel)
+		}
+
+		// keep going while a full batch was reclaimed
+		if n == defaultLeaseReapBatch && ctx.Err() == nil {
+			continue
+		}
+
+		if !sleep(ctx, p.config().ReapPeriod) {
+			return
+		}
+	}
+}
+
+// end the cooldowns passed, return the end of the next one in milliseconds, 0 if none.
+func (p *ProxyPool) endCooldowns() (int64, error) {
+	c := p.pool.Get()
+	defer c.Close()
+
+	if err := c.Err(); err != nil {
+		return 0, err
+	}
+
+	args := p.leaseArgs(p.keys.poolWaitersKey(p.channel), p.keys.poolCooldownKey(p.channel)).
+		Add(p.nowMillis(), p.keys.poolWakePrefix(p.channel), p.keys.poolAlivePrefix(p.channel))
+	return redis.Int64(cooldownScript.Do(c, args...))
+}
+
+// hand the proxies to the waiters of channel as their cooldown ends, waiters are not handed proxies in cooldown.
+func (p *ProxyPool) cool(ctx context.Context) {
+	for {
+		next, err := p.endCooldowns()
+		if err != nil {
+			log.Error(err)
+		}
+
+		// the cooldowns started after this pass end a cooldown from now at the earliest
+		wait := cooldownPoll
+		if cooldown := p.config().Cooldown; cooldown > 0 && cooldown < wait {
+			wait = cooldown
+		}
+		if next > 0 {
+			if d := time.Duration(next-p.nowMillis()) * time.Millisecond; d < wait {
+				wait = d
+			}
+		}
+		if wait < cooldownMinPoll {
+			wait = cooldownMinPoll
+		}
+
+		if !sleep(ctx, wait) {
+			return
+		}
+	}
+}
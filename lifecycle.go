@@ -0,0 +1,54 @@
+package proxypool
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// runner tracks the background loops of a service, so that they can be stopped together.
+type runner struct {
+	ctx    context.Context
+	cancel context.CancelFunc
+	wg     sync.WaitGroup
+	once   sync.Once
+}
+
+func newRunner() *runner {
+	r := &runner{}
+	r.ctx, r.cancel = context.WithCancel(context.Background())
+	return r
+}
+
+// start a background loop, the loop must return when ctx is done.
+func (r *runner) spawn(loop func(ctx context.Context)) {
+	r.wg.Add(1)
+	go func() {
+		defer r.wg.Done()
+		loop(r.ctx)
+	}()
+}
+
+// cancel all loops and wait for them to return, return false if already stopped.
+func (r *runner) stop() bool {
+	stopped := false
+	r.once.Do(func() {
+		r.cancel()
+		r.wg.Wait()
+		stopped = true
+	})
+	return stopped
+}
+
+// sleep for the duration, return false if ctx is done before.
+func sleep(ctx context.Context, d time.Duration) bool {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+
+	select {
+	case <-ctx.Done():
+		return false
+	case <-timer.C:
+		return true
+	}
+}
@@ -0,0 +1,155 @@
+package proxypool
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/garyburd/redigo/redis"
+	"github.com/seaguest/log"
+)
+
+const (
+	defaultLowWaterPeriod   = time.Second * 10 // in seconds
+	fetchDemandBlockTimeout = 1                // in seconds, BLPOP timeout of proxy center
+	fetchDemandMaxLen       = 100
+
+	// lease of the proxies borrowed from the fallback tunnel, settling them is a no-op
+	tunnelLease = "tunnel"
+)
+
+// LowWater is emitted when a channel has fewer proxies than its MinSize.
+type LowWater struct {
+	Channel string
+
+	// proxies available or leased in channel
+	Size    int
+	MinSize int
+	At      time.Time
+}
+
+// register fn to be called on each low water check failing, e.g. to alert.
+// fn is called from a background loop and must not block.
+func (p *ProxyPool) OnLowWater(fn func(LowWater)) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.onLowWater = fn
+}
+
+// check the channel size against MinSize, asking proxy center for more and emitting LowWater when below.
+func (p *ProxyPool) watchLowWater(ctx context.Context) {
+	for {
+		if p.config().MinSize > 0 {
+			if err := p.checkLowWater(); err != nil {
+				log.Error(err)
+			}
+		}
+
+		if !sleep(ctx, p.config().LowWaterPeriod) {
+			return
+		}
+	}
+}
+
+func (p *ProxyPool) checkLowWater() error {
+	size, err := p.size()
+	if err != nil {
+		return err
+	}
+
+	if size >= p.config().MinSize {
+		return nil
+	}
+
+	if err := pushFetchDemand(p.channel, p.keys, p.pool); err != nil {
+		log.Error(err)
+	}
+
+	event := LowWater{Channel: p.channel, Size: size, MinSize: p.config().MinSize, At: time.Now()}
+	log.Errorf("channel [%s] has [%d] proxies, below its minimum [%d]", event.Channel, event.Size, event.MinSize)
+
+	p.mu.Lock()
+	fn := p.onLowWater
+	p.mu.Unlock()
+	if fn != nil {
+		fn(event)
+	}
+	return nil
+}
+
+// proxies available or leased in channel
+func (p *ProxyPool) size() (int, error) {
+	c := p.pool.Get()
+	defer c.Close()
+
+	if err := c.Err(); err != nil {
+		return 0, err
+	}
+
+	c.Send("ZCARD", p.keys.poolKey(p.channel))
+	c.Send("HLEN", p.keys.poolLeasedKey(p.channel))
+	counts, err := redis.Ints(c.Do(""))
+	if err != nil {
+		return 0, err
+	}
+	return counts[0] + counts[1], nil
+}
+
+// the fallback tunnel as a proxy, nil if none is configured.
+func (p *ProxyPool) borrowTunnel() *Member {
+	if p.config().FallbackTunnel == "" {
+		return nil
+	}
+	log.Errorf("channel [%s] is dry, borrowing fallback tunnel [%s]", p.channel, p.config().FallbackTunnel)
+	return &Member{Member: p.config().FallbackTunnel, Lease: tunnelLease}
+}
+
+// true if the proxy was borrowed from the fallback tunnel, it is not part of channel.
+func isTunnel(proxy *Member) bool {
+	return proxy.Lease == tunnelLease
+}
+
+// ask proxy center to fetch at once for the channel.
+func pushFetchDemand(channel string, keys keyspace, pool *redis.Pool) error {
+	c := pool.Get()
+	defer c.Close()
+
+	if err := c.Err(); err != nil {
+		return err
+	}
+
+	// bounded, a late center only needs to know that some channel is low
+	c.Send("RPUSH", keys.fetchDemandKey(), channel)
+	c.Send("LTRIM", keys.fetchDemandKey(), -fetchDemandMaxLen, -1)
+	_, err := c.Do("")
+	return err
+}
+
+// wait for a channel asking for proxies, empty if none within the block timeout.
+func popFetchDemand(keys keyspace, pool *redis.Pool) (string, error) {
+	c := pool.Get()
+	defer c.Close()
+
+	if err := c.Err(); err != nil {
+		return "", err
+	}
+
+	reply, err := redis.Strings(c.Do("BLPOP", keys.fetchDemandKey(), fetchDemandBlockTimeout))
+	if err == redis.ErrNil {
+		return "", nil
+	}
+	if err != nil {
+		return "", err
+	}
+	return reply[1], nil
+}
+
+func validLowWater(c *PoolConfig) error {
+	if c.MinSize < 0 {
+		return errors.New("pool min_size must not be negative")
+	}
+	if c.LowWaterPeriod <= 0 {
+		return errors.New("pool low_water_period must be positive")
+	}
+	return nil
+}
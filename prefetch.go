@@ -0,0 +1,109 @@
+package proxypool
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/seaguest/log"
+)
+
+// a proxy leased ahead of time, handed out by Take until stale.
+type prefetched struct {
+	proxy *Member
+
+	// half the lease ttl, so that the taker still has the other half to use it
+	staleAt time.Time
+}
+
+// leases taken ahead of time by this process, each one is handed to a single caller.
+type prefetchBuffer struct {
+	mu      sync.Mutex
+	entries []prefetched
+}
+
+// pop a fresh proxy, and the stale ones met on the way.
+func (b *prefetchBuffer) pop(now time.Time) (*Member, []*Member) {
+	var stale []*Member
+	for len(b.entries) > 0 {
+		e := b.entries[0]
+		b.entries = b.entries[1:]
+		if now.Before(e.staleAt) {
+			return e.proxy, stale
+		}
+		stale = append(stale, e.proxy)
+	}
+	return nil, stale
+}
+
+// remove the stale proxies, all of them if now is zero.
+func (b *prefetchBuffer) drain(now time.Time) []*Member {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	var stale []*Member
+	kept := b.entries[:0]
+	for _, e := range b.entries {
+		if now.IsZero() || !now.Before(e.staleAt) {
+			stale = append(stale, e.proxy)
+		} else {
+			kept = append(kept, e)
+		}
+	}
+	b.entries = kept
+	return stale
+}
+
+// take a proxy from the local buffer, leasing a batch of Prefetch proxies in one script when it is empty.
+// nil if the channel has none available, the caller falls back to TakeWith.
+func (p *ProxyPool) takePrefetched() *Member {
+	p.prefetch.mu.Lock()
+	now := p.now()
+	proxy, stale := p.prefetch.pop(now)
+	if proxy == nil {
+		proxies, err := p.selectLeases(nil, p.config().Prefetch, nil)
+		if err != nil {
+			log.Error(err)
+		}
+
+		staleAt := now.Add(p.config().LeaseTTL / 2)
+		for _, proxy := range proxies {
+			p.prefetch.entries = append(p.prefetch.entries, prefetched{proxy: proxy, staleAt: staleAt})
+		}
+		proxy, _ = p.prefetch.pop(now)
+	}
+	p.prefetch.mu.Unlock()
+
+	p.returnPrefetched(stale)
+	return proxy
+}
+
+// return unused proxies to channel, their score unchanged and without cooldown.
+func (p *ProxyPool) returnPrefetched(proxies []*Member) {
+	if len(proxies) == 0 {
+		return
+	}
+
+	if _, err := p.freeLeases(proxies, 0, 0); err != nil {
+		log.Error(err)
+	}
+}
+
+// return the stale proxies of the buffer before their lease expires.
+func (p *ProxyPool) sweepPrefetch(ctx context.Context) {
+	if p.config().Prefetch <= 0 {
+		return
+	}
+
+	for sleep(ctx, p.config().LeaseTTL/4) {
+		p.returnPrefetched(p.prefetch.drain(p.now()))
+	}
+}
+
+func validPrefetch(c *PoolConfig) error {
+	if c.Prefetch < 0 {
+		return errors.New("pool prefetch must not be negative")
+	}
+	return nil
+}
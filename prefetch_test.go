@@ -0,0 +1,113 @@
+package proxypool
+
+import (
+	"fmt"
+	"os"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// redis to run the benchmarks against, they are skipped if unset, e.g. PROXYPOOL_BENCH_REDIS=127.0.0.1:6390
+const benchRedisEnv = "PROXYPOOL_BENCH_REDIS"
+
+// Take and Free under contention, straight from channel
+func BenchmarkTake(b *testing.B) {
+	benchmarkTake(b, 0)
+}
+
+// Take and Free under contention, from the prefetch buffer
+func BenchmarkTakePrefetch(b *testing.B) {
+	benchmarkTake(b, 16)
+}
+
+func TestPrefetchBuffer(t *testing.T) {
+	now := time.Now()
+	entry := func(member string, stale time.Duration) prefetched {
+		return prefetched{proxy: &Member{Member: member}, staleAt: now.Add(stale)}
+	}
+	members := func(proxies []*Member) []string {
+		var s []string
+		for _, proxy := range proxies {
+			s = append(s, proxy.Member)
+		}
+		return s
+	}
+
+	tests := []struct {
+		name    string
+		entries []prefetched
+		pop     string
+		popped  []string
+		drained []string
+		kept    []string
+	}{
+		{"empty", nil, "", nil, nil, nil},
+		{"fresh first", []prefetched{entry("a", time.Second), entry("b", -time.Second)}, "a", nil, []string{"b"}, nil},
+		{"stale skipped", []prefetched{entry("a", -time.Second), entry("b", 0), entry("c", time.Second), entry("d", -time.Second)},
+			"c", []string{"a", "b"}, []string{"d"}, nil},
+		{"all stale", []prefetched{entry("a", -time.Second), entry("b", -time.Minute)}, "", []string{"a", "b"}, nil, nil},
+		{"fresh kept", []prefetched{entry("a", time.Second), entry("b", time.Second), entry("c", -time.Second)},
+			"a", nil, []string{"c"}, []string{"b"}},
+	}
+	for _, tt := range tests {
+		b := &prefetchBuffer{entries: append([]prefetched(nil), tt.entries...)}
+		proxy, stale := b.pop(now)
+		if (proxy == nil && tt.pop != "") || (proxy != nil && proxy.Member != tt.pop) {
+			t.Errorf("%s: pop = %v, want %q", tt.name, proxy, tt.pop)
+		}
+		if got := members(stale); !reflect.DeepEqual(got, tt.popped) {
+			t.Errorf("%s: stale on pop = %v, want %v", tt.name, got, tt.popped)
+		}
+		if got := members(b.drain(now)); !reflect.DeepEqual(got, tt.drained) {
+			t.Errorf("%s: drained = %v, want %v", tt.name, got, tt.drained)
+		}
+
+		var kept []*Member
+		for _, e := range b.entries {
+			kept = append(kept, e.proxy)
+		}
+		if got := members(kept); !reflect.DeepEqual(got, tt.kept) {
+			t.Errorf("%s: kept = %v, want %v", tt.name, got, tt.kept)
+		}
+	}
+
+	// a zero time drains everything
+	b := &prefetchBuffer{entries: []prefetched{entry("a", time.Hour), entry("b", -time.Hour)}}
+	if got := members(b.drain(time.Time{})); !reflect.DeepEqual(got, []string{"a", "b"}) || len(b.entries) != 0 {
+		t.Errorf("drain all = %v, left %d", got, len(b.entries))
+	}
+}
+
+func benchmarkTake(b *testing.B, prefetch int) {
+	addr := os.Getenv(benchRedisEnv)
+	if addr == "" {
+		b.Skipf("%s not set", benchRedisEnv)
+	}
+
+	conf := DefaultConfig()
+	conf.Redis.Addr = addr
+	conf.KeyPrefix = fmt.Sprintf("bench_%d_", time.Now().UnixNano())
+	conf.Pool.Prefetch = prefetch
+
+	members := make([]string, 1000)
+	for i := range members {
+		members[i] = fmt.Sprintf("10.%d.%d.%d:8080", i>>16&255, i>>8&255, i&255)
+	}
+
+	pp, cleanup, err := newScratchPool(conf, "bench", members, time.Now)
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer cleanup()
+
+	b.SetParallelism(8)
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			if proxy := pp.Take(); proxy != nil {
+				pp.Free(proxy)
+			}
+		}
+	})
+}
@@ -2,6 +2,8 @@ package provider
 
 import (
 	"fmt"
+	"net"
+	"strconv"
 
 	"github.com/imroc/req"
 	"github.com/seaguest/log"
@@ -85,7 +87,7 @@ func (p *Data5uProxyProvider) FetchProxy() ([]string, error) {
 
 	var proxies []string
 	for _, data5uProxy := range response.Data {
-		proxy := fmt.Sprintf("%s:%d", data5uProxy.Ip, data5uProxy.Port)
+		proxy := net.JoinHostPort(data5uProxy.Ip, strconv.Itoa(data5uProxy.Port))
 		proxies = append(proxies, proxy)
 	}
 	return proxies, nil
@@ -2,6 +2,8 @@ package proxypool
 
 import (
 	"fmt"
+	"net"
+	"strings"
 
 	"github.com/garyburd/redigo/redis"
 	"github.com/seaguest/log"
@@ -13,37 +15,402 @@ type Proxy struct {
 	Anonymity   int    `redis:"anonymity"`
 	Rtt         int    `redis:"rtt"`
 	ValidatedAt int64  `redis:"validated_at"`
+	Https       bool   `redis:"https"`
+
+	// /24 or /48 of the ip, set on validation
+	Subnet string `redis:"subnet"`
+
+	// metadata set by SetProxyMeta, lists are comma separated
+	Protocols string `redis:"protocols"`
+	Country   string `redis:"country"`
+	Region    string `redis:"region"`
+	Labels    string `redis:"labels"`
+	ASN       int    `redis:"asn"`
+
+	// max concurrent leases in a channel, 0 for the channel setting
+	Concurrency int `redis:"concurrency"`
+
+	// proxy-level failures reported by the channels since the last validation, see PoolConfig.ProxyFailureLimit
+	Failures int `redis:"failures"`
+}
+
+// metadata of a proxy known from the provider or the operator, used by TakeWith.
+type ProxyMeta struct {
+	// e.g. https, socks5
+	Protocols []string
+	Country   string
+	Region    string
+	Labels    []string
+
+	// autonomous system number, 0 if unknown
+	ASN int
+
+	// max concurrent leases in a channel, 0 for the channel setting
+	Concurrency int
 }
 
 /**************** define the redis cache key ****************/
-func getProxyKey(ip, port string) string {
-	return fmt.Sprintf("%s%s:%s", proxyPrefix, ip, port)
+// keyspace builds every redis key, with an optional prefix shared by a deployment.
+type keyspace struct {
+	prefix string
+}
+
+func (k keyspace) proxyPrefix() string {
+	return k.prefix + proxyPrefix
+}
+
+// pattern matching every proxy key, but not the other keys sharing the prefix
+func (k keyspace) proxyPattern() string {
+	return k.proxyPrefix() + "*:*"
+}
+
+func (k keyspace) proxyKey(ip, port string) string {
+	return k.proxyPrefix() + net.JoinHostPort(ip, port)
+}
+
+func (k keyspace) indexKey() string {
+	return k.prefix + proxyIndexKey
+}
+
+// proxies by validation rtt
+func (k keyspace) rttKey() string {
+	return k.prefix + proxyRttKey
+}
+
+// prefix of the leases of a proxy across channels, followed by the proxy
+func (k keyspace) globalLeasePrefix() string {
+	return k.prefix + proxyLeasePrefix
+}
+
+// proxies banned by the target host by end of the ban, shared by every channel
+func (k keyspace) burnKey(host string) string {
+	return k.prefix + proxyBurnPrefix + host
+}
+
+func (k keyspace) blockedSet() string {
+	return k.prefix + proxyBlockedSet
+}
+
+func (k keyspace) poolKey(channel string) string {
+	return fmt.Sprintf("%s%s%s", k.prefix, proxyPoolPrefix, channel)
+}
+
+func (k keyspace) poolBlockedKey(channel string) string {
+	return fmt.Sprintf("%s%s%s", k.prefix, proxyPoolBlockedPrefix, channel)
+}
+
+// leases of the channel by deadline
+func (k keyspace) poolLeaseKey(channel string) string {
+	return fmt.Sprintf("%s%s%s", k.prefix, proxyPoolLeasePrefix, channel)
+}
+
+// score of the proxy when leased, by lease id
+func (k keyspace) poolLeaseInfoKey(channel string) string {
+	return fmt.Sprintf("%s%s%s", k.prefix, proxyPoolLeaseInfo, channel)
+}
+
+// number of active leases, by proxy
+func (k keyspace) poolLeasedKey(channel string) string {
+	return fmt.Sprintf("%s%s%s", k.prefix, proxyPoolLeasedPrefix, channel)
+}
+
+func (k keyspace) poolLeaseSeqKey(channel string) string {
+	return fmt.Sprintf("%s%s%s", k.prefix, proxyPoolLeaseSeq, channel)
+}
+
+// members of the channel by the lease sequence they were last taken at
+func (k keyspace) poolRoundRobinKey(channel string) string {
+	return fmt.Sprintf("%s%s%s", k.prefix, proxyPoolRoundRobin, channel)
+}
+
+// members of the channel by validation rtt, including the leased ones
+func (k keyspace) poolRttKey(channel string) string {
+	return fmt.Sprintf("%s%s%s", k.prefix, proxyPoolRttPrefix, channel)
+}
+
+// health score of the members, by proxy
+func (k keyspace) poolHealthKey(channel string) string {
+	return fmt.Sprintf("%s%s%s", k.prefix, proxyPoolHealthPrefix, channel)
+}
+
+// list of the processes waiting in TakeContext, in arrival order
+func (k keyspace) poolWaitersKey(channel string) string {
+	return fmt.Sprintf("%s%s%s", k.prefix, proxyPoolWaitersPrefix, channel)
+}
+
+// prefix of the list a process of channel is woken up through, followed by the process id
+func (k keyspace) poolWakePrefix(channel string) string {
+	return fmt.Sprintf("%s%s%s_", k.prefix, proxyPoolWakePrefix, channel)
+}
+
+// prefix of the key kept while a process of channel dispatches wake ups, followed by the process id
+func (k keyspace) poolAlivePrefix(channel string) string {
+	return fmt.Sprintf("%s%s%s_", k.prefix, proxyPoolAlivePrefix, channel)
+}
+
+// proxies of the channel by the end of their cooldown
+func (k keyspace) poolCooldownKey(channel string) string {
+	return fmt.Sprintf("%s%s%s", k.prefix, proxyPoolCooldownKey, channel)
+}
+
+// prefix of the token buckets of channel for the target host, followed by the proxy
+func (k keyspace) poolBucketPrefix(channel, host string) string {
+	return fmt.Sprintf("%s%s%s_%s_", k.prefix, proxyPoolBucketPrefix, channel, host)
+}
+
+// proxy bound to the session of channel
+func (k keyspace) poolSessionKey(channel, session string) string {
+	return fmt.Sprintf("%s%s%s_%s", k.prefix, proxyPoolSessionPrefix, channel, session)
+}
+
+// hard failures in a row of the members, by proxy
+func (k keyspace) poolStrikesKey(channel string) string {
+	return fmt.Sprintf("%s%s%s", k.prefix, proxyPoolStrikesPrefix, channel)
+}
+
+// blocks of the members since they were last fully healthy, by proxy
+func (k keyspace) poolOffencesKey(channel string) string {
+	return fmt.Sprintf("%s%s%s", k.prefix, proxyPoolOffencePrefix, channel)
+}
+
+// decayed success and failure counts of the members, by proxy:s, proxy:f and proxy:t for the last update
+func (k keyspace) poolBanditKey(channel string) string {
+	return fmt.Sprintf("%s%s%s", k.prefix, proxyPoolBanditPrefix, channel)
+}
+
+// diversity groups of the members taken within the window, by time taken
+func (k keyspace) poolRecentKey(channel string) string {
+	return fmt.Sprintf("%s%s%s", k.prefix, proxyPoolRecentPrefix, channel)
+}
+
+// prefix of the members of a subnet failed within the window, followed by the subnet
+func (k keyspace) poolSubnetFailurePrefix(channel string) string {
+	return fmt.Sprintf("%s%s%s_", k.prefix, proxyPoolSubnetFailure, channel)
+}
+
+// subnets blocked in channel, by end of the block in milliseconds
+func (k keyspace) poolSubnetBlockedKey(channel string) string {
+	return fmt.Sprintf("%s%s%s", k.prefix, proxyPoolSubnetBlocked, channel)
+}
+
+// settings of channel overriding its pool configuration, by yaml name
+func (k keyspace) poolConfigKey(channel string) string {
+	return fmt.Sprintf("%s%s%s", k.prefix, proxyPoolConfigPrefix, channel)
+}
+
+// lock held by the process refilling channel
+func (k keyspace) poolRefillLockKey(channel string) string {
+	return fmt.Sprintf("%s%s%s", k.prefix, proxyPoolRefillLock, channel)
+}
+
+// pub/sub channel of the proxies added, updated or removed in proxy center
+func (k keyspace) eventChannel() string {
+	return k.prefix + proxyEventChannel
+}
+
+// channels below their minimum size, asking proxy center to fetch at once
+func (k keyspace) fetchDemandKey() string {
+	return k.prefix + proxyFetchDemandKey
+}
+
+func (k keyspace) validationStream() string {
+	return k.prefix + proxyValidationStream
 }
 
-func getProxyPoolKey(channel string) string {
-	return fmt.Sprintf("%s%s", proxyPoolPrefix, channel)
+func (k keyspace) validatingSet() string {
+	return k.prefix + proxyValidatingSet
 }
 
-func getProxyBlockedKey(channel string) string {
-	return fmt.Sprintf("%s%s", proxyPoolBlockedPrefix, channel)
+func (k keyspace) leaderKey() string {
+	return k.prefix + proxyLeaderKey
 }
 
-func saveProxy(p *Proxy, pool *redis.Pool) error {
-	key := getProxyKey(p.Ip, p.Port)
+func (k keyspace) fencingKey() string {
+	return k.prefix + proxyFencingKey
+}
 
-	if err := setObject(key, p, pool); err != nil {
+// save the proxy hash and index it by validation time and rtt in one step.
+// the channels are told with an add or update event.
+var saveProxyScript = redis.NewScript(4, `
+	redis.call('HMSET', KEYS[1], unpack(ARGV, 4))
+	local added = redis.call('ZADD', KEYS[2], ARGV[1], ARGV[3])
+	redis.call('ZADD', KEYS[3], ARGV[2], ARGV[3])
+	if added == 1 then
+	    redis.call('PUBLISH', KEYS[4], 'add|' .. ARGV[3])
+	else
+	    redis.call('PUBLISH', KEYS[4], 'update|' .. ARGV[3])
+	end
+	return 1`)
+
+// delete the proxy hash and remove it from indexes in one step, the channels are told with a remove event.
+var deleteProxyScript = redis.NewScript(4, `
+	redis.call('DEL', KEYS[1])
+	redis.call('ZREM', KEYS[3], ARGV[1])
+	local removed = redis.call('ZREM', KEYS[2], ARGV[1])
+	if removed == 1 then
+	    redis.call('PUBLISH', KEYS[4], 'remove|' .. ARGV[1])
+	end
+	return removed`)
+
+func saveProxy(p *Proxy, keys keyspace, pool *redis.Pool) error {
+	c := pool.Get()
+	defer c.Close()
+
+	if err := c.Err(); err != nil {
+		log.Error(err)
+		return err
+	}
+
+	// only the validation fields, metadata is kept, a validation clears the failures
+	key := keys.proxyKey(p.Ip, p.Port)
+	args := redis.Args{}.Add(key, keys.indexKey(), keys.rttKey(), keys.eventChannel(), p.ValidatedAt, p.Rtt, net.JoinHostPort(p.Ip, p.Port)).
+		Add("ip", p.Ip, "port", p.Port, "anonymity", p.Anonymity, "rtt", p.Rtt, "validated_at", p.ValidatedAt, "https", p.Https, "failures", 0).
+		Add("subnet", subnetOf(p.Ip))
+	if _, err := saveProxyScript.Do(c, args...); err != nil {
 		log.Error(err)
 		return err
 	}
 	return nil
 }
 
-func getProxy(key string, pool *redis.Pool) (*Proxy, error) {
-	var proxy Proxy
+func deleteProxy(ip, port string, keys keyspace, pool *redis.Pool) error {
+	c := pool.Get()
+	defer c.Close()
 
-	if err := getObject(key, &proxy, pool); err != nil {
+	if err := c.Err(); err != nil {
 		log.Error(err)
+		return err
+	}
+
+	_, err := deleteProxyScript.Do(c, keys.proxyKey(ip, port), keys.indexKey(), keys.rttKey(), keys.eventChannel(), net.JoinHostPort(ip, port))
+	return err
+}
+
+// count a proxy-level failure of a proxy present in proxy center, return the failures since its last validation.
+var proxyFailureScript = redis.NewScript(1, `
+	if redis.call('EXISTS', KEYS[1]) == 0 then
+	    return 0
+	end
+	return redis.call('HINCRBY', KEYS[1], 'failures', 1)`)
+
+func addProxyFailure(ip, port string, keys keyspace, pool *redis.Pool) (int, error) {
+	c := pool.Get()
+	defer c.Close()
+
+	if err := c.Err(); err != nil {
+		return 0, err
+	}
+
+	return redis.Int(proxyFailureScript.Do(c, keys.proxyKey(ip, port)))
+}
+
+// set the metadata of a proxy present in proxy center.
+// KEYS: 1 proxy hash, 2 event channel; ARGV: 1 member, then the fields
+var setProxyMetaScript = redis.NewScript(2, `
+	if redis.call('EXISTS', KEYS[1]) == 0 then
+	    return 0
+	end
+	redis.call('HMSET', KEYS[1], unpack(ARGV, 2))
+	redis.call('PUBLISH', KEYS[2], 'update|' .. ARGV[1])
+	return 1`)
+
+func setProxyMeta(ip, port string, meta *ProxyMeta, keys keyspace, pool *redis.Pool) (bool, error) {
+	c := pool.Get()
+	defer c.Close()
+
+	if err := c.Err(); err != nil {
+		return false, err
+	}
+
+	args := redis.Args{}.Add(keys.proxyKey(ip, port), keys.eventChannel(), net.JoinHostPort(ip, port)).
+		Add("protocols", strings.Join(meta.Protocols, ","), "country", meta.Country, "region", meta.Region,
+			"labels", strings.Join(meta.Labels, ","), "asn", meta.ASN, "concurrency", meta.Concurrency)
+	return redis.Bool(setProxyMetaScript.Do(c, args...))
+}
+
+// all proxies in proxy center, as ip:port
+func getIndexedProxies(keys keyspace, pool *redis.Pool) ([]string, error) {
+	c := pool.Get()
+	defer c.Close()
+
+	if err := c.Err(); err != nil {
+		return nil, err
+	}
+
+	return redis.Strings(c.Do("ZRANGE", keys.indexKey(), 0, -1))
+}
+
+// proxies validated before the timestamp, as ip:port
+func getOutdatedProxies(before int64, keys keyspace, pool *redis.Pool) ([]string, error) {
+	c := pool.Get()
+	defer c.Close()
+
+	if err := c.Err(); err != nil {
 		return nil, err
 	}
-	return &proxy, nil
+
+	return redis.Strings(c.Do("ZRANGEBYSCORE", keys.indexKey(), "-inf", before))
+}
+
+// build the index from the proxy hashes with SCAN, and drop index members without hash.
+// it is safe to run on a live center, it only fixes what is missing.
+func migrateProxyIndex(keys keyspace, pool *redis.Pool) (int, error) {
+	var added int
+	err := scanKeys(keys.proxyPattern(), pool, func(batch []string) error {
+		c := pool.Get()
+		defer c.Close()
+
+		for _, key := range batch {
+			c.Send("HMGET", key, "validated_at", "rtt")
+		}
+		if err := c.Flush(); err != nil {
+			return err
+		}
+
+		args := redis.Args{}.Add(keys.indexKey(), "NX")
+		rttArgs := redis.Args{}.Add(keys.rttKey(), "NX")
+		for _, key := range batch {
+			values, err := redis.Int64s(c.Receive())
+			if err != nil {
+				// not a proxy hash
+				continue
+			}
+			member := strings.TrimPrefix(key, keys.proxyPrefix())
+			args = args.Add(values[0], member)
+			rttArgs = rttArgs.Add(values[1], member)
+		}
+
+		if len(args) == 2 {
+			return nil
+		}
+
+		n, err := redis.Int(c.Do("ZADD", args...))
+		if err != nil {
+			return err
+		}
+		added += n
+
+		_, err = c.Do("ZADD", rttArgs...)
+		return err
+	})
+	if err != nil {
+		return added, err
+	}
+
+	proxies, err := getIndexedProxies(keys, pool)
+	if err != nil {
+		return added, err
+	}
+
+	for _, proxy := range proxies {
+		if !exists(keys.proxyPrefix()+proxy, pool) {
+			if err := zrem(keys.indexKey(), proxy, pool); err != nil {
+				return added, err
+			}
+			if err := zrem(keys.rttKey(), proxy, pool); err != nil {
+				return added, err
+			}
+		}
+	}
+	return added, nil
 }
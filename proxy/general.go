@@ -1,6 +1,7 @@
 package proxy
 
 import (
+	"context"
 	"errors"
 	"fmt"
 	"net/http"
@@ -26,15 +27,36 @@ func GetGeneralProxy(redisAddr, redisPassword, channel string, valid func(interf
 	return proxy
 }
 
+// release the underlying proxy pool
+func (p *GeneralProxy) Close() error {
+	return p.pool.Close()
+}
+
 func (p *GeneralProxy) SetAuth(auth map[string]string) {
 	p.Auth = auth
 }
 
-func (p *GeneralProxy) Get(url string, input, output interface{}, timeout int) error {
-	proxy := p.pool.Take()
-	if proxy == nil {
-		err := errors.New("no available proxy")
+// take a proxy, waiting for one to be freed up to the request timeout
+func (p *GeneralProxy) take(timeout int) (*proxypool.Member, error) {
+	if timeout == 0 {
+		timeout = proxypool.DefaultTimeout
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Duration(timeout)*time.Millisecond)
+	defer cancel()
+
+	proxy, err := p.pool.TakeContext(ctx)
+	if err != nil {
+		err = fmt.Errorf("no available proxy: %v", err)
 		log.Error(err)
+		return nil, err
+	}
+	return proxy, nil
+}
+
+func (p *GeneralProxy) Get(url string, input, output interface{}, timeout int) error {
+	proxy, err := p.take(timeout)
+	if err != nil {
 		return err
 	}
 	proxyUrl := fmt.Sprintf("http://%s", proxy.Member)
@@ -53,11 +75,10 @@ func (p *GeneralProxy) Get(url string, input, output interface{}, timeout int) e
 	}
 
 	var resp *request.Resp
-	var err error
 
 	defer func() {
 		if err != nil {
-			p.pool.Delete(proxy.Member)
+			p.pool.DeleteWithReason(proxy, proxypool.BlockTarget)
 			return
 		}
 
@@ -96,10 +117,8 @@ func (p *GeneralProxy) Get(url string, input, output interface{}, timeout int) e
 }
 
 func (p *GeneralProxy) GetRaw(url string, input interface{}, timeout int) (string, error) {
-	proxy := p.pool.Take()
-	if proxy == nil {
-		err := errors.New("no available proxy")
-		log.Error(err)
+	proxy, err := p.take(timeout)
+	if err != nil {
 		return "", err
 	}
 	proxyUrl := fmt.Sprintf("http://%s", proxy.Member)
@@ -118,11 +137,10 @@ func (p *GeneralProxy) GetRaw(url string, input interface{}, timeout int) (strin
 	}
 
 	var resp *request.Resp
-	var err error
 
 	defer func() {
 		if err != nil {
-			p.pool.Delete(proxy.Member)
+			p.pool.DeleteWithReason(proxy, proxypool.BlockTarget)
 			return
 		}
 
@@ -170,10 +188,8 @@ func (p *GeneralProxy) Post(url string, input, output interface{}, timeout int)
 	req.SetTimeout(time.Duration(timeout) * time.Millisecond)
 
 	// set proxy
-	proxy := p.pool.Take()
-	if proxy == nil {
-		err := errors.New("no available proxy")
-		log.Error(err)
+	proxy, err := p.take(timeout)
+	if err != nil {
 		return err
 	}
 
@@ -187,11 +203,10 @@ func (p *GeneralProxy) Post(url string, input, output interface{}, timeout int)
 	}
 
 	var resp *request.Resp
-	var err error
 
 	defer func() {
 		if err != nil {
-			p.pool.Delete(proxy.Member)
+			p.pool.DeleteWithReason(proxy, proxypool.BlockTarget)
 			return
 		}
 
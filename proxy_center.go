@@ -1,8 +1,9 @@
 package proxypool
 
 import (
+	"context"
 	"fmt"
-	"strings"
+	"net"
 	"sync"
 	"time"
 
@@ -19,8 +20,6 @@ const (
 	defaultBlockedCleanPeriod     = time.Second * 60  // in seconds
 	defaultProxyCacheTTL          = time.Second * 1   // in seconds
 	defaultBlockCacheTTL          = time.Second * 1   // in seconds
-	defaultMaxRoutine             = 500
-	defaultProxyCenterChanSize    = 2000
 )
 
 // ProxyCenter is responsible for fetching proxies from other sites, and managing the global proxy pool.
@@ -29,71 +28,144 @@ type ProxyCenter struct {
 	// redis pool
 	pool *redis.Pool
 
-	// proxy channel for validation
-	proxyChan chan string
+	// redis keys
+	keys keyspace
+
+	// worker consuming the validation queue, nil if validation runs in standalone workers
+	worker *ValidationWorker
+
+	// leader election among replicas, only the leader fetches and schedules
+	elector *leaderElector
 
 	// providers which fetch proxies from third sites
 	providers []provider.ProxyProvider
 
-	// proxy ttl in the proxy center, in second
-	validationPeriod time.Duration
+	// wake up the fetch loop of each provider before its period
+	fetchNow []chan struct{}
 
-	// proxy load period, in second
-	loadPeriod time.Duration
-
-	// max routinue for validation
-	maxRoutine int
+	// center configuration
+	conf CenterConfig
 
 	// cache holding the channel blocked proxy
 	blockCache *cache.Cache
 
 	// mutex for blocked_proxy
 	mu sync.Mutex
+
+	// background services
+	runner *runner
 }
 
 // create a new *ProxyCenter
 func NewProxyCenter(redisAddr, redisPassword string, validationPeriod, loadPeriod time.Duration, maxRoutine int) *ProxyCenter {
-	p := &ProxyCenter{}
-	p.pool = NewRedisPool(redisAddr, redisPassword)
-	p.proxyChan = make(chan string, defaultProxyCenterChanSize)
+	conf := DefaultConfig()
+	conf.Redis.Addr = redisAddr
+	conf.Redis.Password = redisPassword
 
-	if validationPeriod == 0 {
-		p.validationPeriod = defaultCenterValidationPeriod
-	} else {
-		p.validationPeriod = validationPeriod
+	if validationPeriod != 0 {
+		conf.Center.ValidationPeriod = validationPeriod
 	}
 
-	if loadPeriod == 0 {
-		p.loadPeriod = defaultLoadPeriod
-	} else {
-		p.loadPeriod = loadPeriod
+	if loadPeriod != 0 {
+		conf.Center.LoadPeriod = loadPeriod
 	}
 
-	if maxRoutine == 0 {
-		p.maxRoutine = defaultMaxRoutine
-	} else {
-		p.maxRoutine = maxRoutine
+	if maxRoutine != 0 {
+		conf.Worker.MaxRoutine = maxRoutine
 	}
 
-	p.blockCache = cache.New(defaultBlockCacheTTL, 0)
+	p, err := NewProxyCenterWithConfig(conf)
+	if err != nil {
+		log.Error(err)
+		return nil
+	}
+	return p
+}
 
-	// by default, add three predefined proxy_provider
-	//p.addProvider(provider.New("data5u"))
-	//p.addProvider(provider.New("daxiang"))
-	p.addProvider(provider.New("kuai"))
+// create a new *ProxyCenter from configuration
+func NewProxyCenterWithConfig(conf *Config) (*ProxyCenter, error) {
+	if err := conf.Validate(); err != nil {
+		return nil, err
+	}
+
+	p := &ProxyCenter{}
+	p.conf = conf.Center
+	p.keys = keyspace{conf.KeyPrefix}
+	p.blockCache = cache.New(p.conf.BlockCacheTTL, 0)
+
+	for _, name := range p.conf.Providers {
+		pd := provider.New(name)
+		if pd == nil {
+			return nil, fmt.Errorf("unknown provider [%s]", name)
+		}
+		p.addProvider(pd)
+	}
+
+	p.pool = NewRedisPoolWithConfig(&conf.Redis)
+	p.runner = newRunner()
+
+	// campaign for leadership
+	p.elector = newLeaderElector(p.pool, p.keys, p.conf.LeaderLeaseTTL, p.conf.LeaderRenewPeriod)
+	p.runner.spawn(p.elector.run)
 
 	// start proxy fetching service
-	go p.fetchProxy()
+	p.fetchProxy()
+
+	// fetch at once when a channel runs low
+	p.runner.spawn(p.watchDemand)
 
 	// start the proxy validation service
-	go p.validate()
+	if p.conf.RunWorker {
+		p.worker = newValidationWorker(p.pool, p.keys, conf.Worker)
+		p.worker.start()
+	}
+
+	// index the proxies saved before the index existed
+	p.runner.spawn(p.migrate)
 
 	// load outdated proxy to validation queue
-	go p.scan()
+	p.runner.spawn(p.scan)
 
 	// start the blocked proxy clean service
-	go p.cleanBlockedProxy()
-	return p
+	p.runner.spawn(p.cleanBlockedProxy)
+	return p, nil
+}
+
+// block until ctx is done, then close the proxy center.
+func (p *ProxyCenter) Run(ctx context.Context) error {
+	<-ctx.Done()
+	return p.Close()
+}
+
+// stop all background services, wait for in-flight validations, give up leadership and close the redis pool.
+func (p *ProxyCenter) Close() error {
+	if !p.runner.stop() {
+		return nil
+	}
+
+	if p.worker != nil {
+		p.worker.stop()
+	}
+	p.elector.resign()
+	return p.pool.Close()
+}
+
+// set the protocols, location and labels of a proxy, used to select it with TakeWith.
+func (p *ProxyCenter) SetProxyMeta(proxy string, meta *ProxyMeta) error {
+	ip, port, err := net.SplitHostPort(proxy)
+	if err != nil {
+		return fmt.Errorf("invalid proxy [%s]", proxy)
+	}
+
+	found, err := setProxyMeta(ip, port, meta, p.keys, p.pool)
+	if err != nil {
+		return err
+	}
+
+	if !found {
+		return fmt.Errorf("proxy [%s] not found", proxy)
+	}
+	return nil
 }
 
 // add provider to proxy center
@@ -102,103 +174,86 @@ func (p *ProxyCenter) addProvider(provider provider.ProxyProvider) {
 }
 
 // scan the proxies in proxy_center, enqueue for validation
-func (p *ProxyCenter) scan() {
+func (p *ProxyCenter) scan(ctx context.Context) {
 	for {
-		keys, err := p.getAllProxyKeys()
-		if err != nil {
-			log.Error(err)
-			return
-		}
-
-		var proxies []string
-		for _, key := range keys {
-			proxy, err := getProxy(key, p.pool)
-			if err != nil {
-				log.Error(err)
-				continue
+		token := p.elector.fencingToken()
+		if token == 0 {
+			// only the leader schedules validation
+			if !sleep(ctx, p.elector.renewPeriod) {
+				return
 			}
+			continue
+		}
 
-			// only validate proxies which have been validated 5 minutes before
-			if time.Now().Sub(time.Unix(proxy.ValidatedAt, 0)) > p.validationPeriod {
-				proxies = append(proxies, fmt.Sprintf("%s:%s", proxy.Ip, proxy.Port))
+		// only validate proxies which have been validated 5 minutes before
+		before := time.Now().Add(-p.conf.ValidationPeriod).Unix()
+		proxies, err := getOutdatedProxies(before, p.keys, p.pool)
+		if err != nil {
+			log.Error(err)
+			if !sleep(ctx, p.elector.renewPeriod) {
+				return
 			}
+			continue
 		}
 
 		log.Error("-------------revalidate proxies...", len(proxies))
 
-		// load proxies to channel to validate
-		p.enqueue(proxies)
+		// load proxies to queue to validate
+		p.enqueue(proxies, token)
 
-		time.Sleep(p.validationPeriod)
-	}
-}
-
-// proxy validation service
-func (p *ProxyCenter) validate() {
-	processProxy := func(proxyStr string) {
-		sps := strings.Split(proxyStr, ":")
-		if len(sps) != 2 {
+		if !sleep(ctx, p.conf.ValidationPeriod) {
 			return
 		}
+	}
+}
 
-		ip := sps[0]
-		port := sps[1]
-
-		rtt, anonymity, valid := validateProxy(ip, port)
-		if !valid {
-			// if proxy is not valid, remove it from global pool.
-			key := getProxyKey(ip, port)
-			delKey(key, p.pool)
-
-			// after remove the invalid proxy, add it to blocked proxy
-			ts := time.Now().Unix()
-			if err := zadd(proxyBlockedSet, proxyStr, ts, p.pool); err != nil {
-				log.Error(err)
+// build the proxy index once the leader, retry until done.
+func (p *ProxyCenter) migrate(ctx context.Context) {
+	for {
+		if p.elector.isLeader() {
+			added, err := migrateProxyIndex(p.keys, p.pool)
+			if err == nil {
+				log.Errorf("proxy index migrated, [%d] proxies added", added)
+				return
 			}
-		} else {
-			// remove proxy from blocked
-			zrem(proxyBlockedSet, proxyStr, p.pool)
-
-			// save to proxy
-			var proxy Proxy
-			proxy.Ip = ip
-			proxy.Port = port
-			proxy.Rtt = rtt
-			proxy.Anonymity = anonymity
-			proxy.ValidatedAt = time.Now().Unix()
-			saveProxy(&proxy, p.pool)
+			log.Error(err)
 		}
 
-	}
-
-	for i := 0; i < p.maxRoutine; i++ {
-		go func() {
-			for {
-				select {
-				case proxy := <-p.proxyChan:
-					processProxy(proxy)
-				}
-			}
-		}()
+		if !sleep(ctx, p.elector.renewPeriod) {
+			return
+		}
 	}
 }
 
-// add proxy to proxy_chan waiting for validation
-func (p *ProxyCenter) enqueue(proxies []string) {
-	for _, proxy := range proxies {
-		select {
-		case p.proxyChan <- proxy:
-		}
+// add proxy to the validation queue in redis
+func (p *ProxyCenter) enqueue(proxies []string, token int64) {
+	if _, err := enqueueValidation(proxies, token, p.keys, p.pool); err != nil {
+		log.Error(err)
 	}
 }
 
 func (p *ProxyCenter) fetchProxy() {
 	for _, pd := range p.providers {
-		go func(pd provider.ProxyProvider) {
-			ticker := time.NewTicker(p.loadPeriod)
+		pd := pd
+		now := make(chan struct{}, 1)
+		p.fetchNow = append(p.fetchNow, now)
+		p.runner.spawn(func(ctx context.Context) {
+			ticker := time.NewTicker(p.conf.LoadPeriod)
 			defer ticker.Stop()
 			for {
-				<-ticker.C
+				select {
+				case <-ctx.Done():
+					return
+				case <-ticker.C:
+				case <-now:
+				}
+
+				// only the leader calls the providers
+				token := p.elector.fencingToken()
+				if token == 0 {
+					continue
+				}
+
 				proxies, err := pd.FetchProxy()
 				if err != nil {
 					log.Error(err)
@@ -206,23 +261,19 @@ func (p *ProxyCenter) fetchProxy() {
 				}
 
 				// find all existing proxies in proxy_center
-				keys, err := p.getAllProxyKeys()
+				existingProxies, err := p.getAllProxies()
 				if err != nil {
 					log.Error(err)
-					return
-				}
-
-				var existingProxies []string
-				for _, key := range keys {
-					proxy := strings.TrimPrefix(key, proxyPrefix)
-					existingProxies = append(existingProxies, proxy)
+					continue
 				}
+				// copy, the cached slice must not be modified
+				existingProxies = append([]string{}, existingProxies...)
 
 				// find all blocked proxy
 				blockedProxies, err := p.getBlockedProxies()
 				if err != nil {
 					log.Error(err)
-					return
+					continue
 				}
 
 				for _, blockedProxy := range blockedProxies {
@@ -231,29 +282,77 @@ func (p *ProxyCenter) fetchProxy() {
 				_, _, addedProxies := util.IntersectString(existingProxies, proxies)
 
 				log.Error("-------------new proxies...", len(addedProxies))
-				p.enqueue(addedProxies)
+				p.enqueue(addedProxies, token)
 			}
-		}(pd)
+		})
+	}
+}
+
+// fetch from every provider at once when a channel asks for more proxies, the new ones are validated right after.
+func (p *ProxyCenter) watchDemand(ctx context.Context) {
+	for {
+		// only the leader calls the providers, the others leave the demand to it
+		if p.elector.fencingToken() == 0 {
+			if !sleep(ctx, p.conf.LeaderRenewPeriod) {
+				return
+			}
+			continue
+		}
+
+		channel, err := popFetchDemand(p.keys, p.pool)
+		if err != nil {
+			log.Error(err)
+			if !sleep(ctx, time.Second) {
+				return
+			}
+			continue
+		}
+
+		if channel != "" {
+			log.Errorf("channel [%s] is low, fetching proxies", channel)
+			for _, now := range p.fetchNow {
+				select {
+				case now <- struct{}{}:
+				default:
+				}
+			}
+		}
+
+		if ctx.Err() != nil {
+			return
+		}
 	}
 }
 
 // if a proxy is in blocked set longer than specified time, then delete it.
-func (p *ProxyCenter) cleanBlockedProxy() {
-	ticker := time.NewTicker(defaultBlockedCleanPeriod)
+func (p *ProxyCenter) cleanBlockedProxy(ctx context.Context) {
+	ticker := time.NewTicker(p.conf.BlockedCleanPeriod)
 	defer ticker.Stop()
 	for {
-		<-ticker.C
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		token := p.elector.fencingToken()
+		if token == 0 {
+			continue
+		}
 
 		blockedProxies, err := p.getBlockedProxies()
 		if err != nil {
 			log.Error(err)
-			return
+			continue
 		}
 
 		for _, blockedProxy := range blockedProxies {
-			if time.Now().Sub(time.Unix(int64(blockedProxy.Score), 0)) > defaultBlockedCleanPeriod {
+			if time.Now().Sub(time.Unix(int64(blockedProxy.Score), 0)) > p.conf.BlockedCleanPeriod {
 				// if blocked_proxy xpires, clean it
-				zrem(proxyBlockedSet, blockedProxy.Member, p.pool)
+				if err := fencedZrem(p.keys.blockedSet(), blockedProxy.Member, token, p.keys, p.pool); err != nil {
+					log.Error(err)
+					break
+				}
 			}
 		}
 	}
@@ -271,13 +370,13 @@ func (p *ProxyCenter) getBlockedProxies() ([]*Member, error) {
 		return blockedIpItf.([]*Member), nil
 	}
 
-	blockedProxies, err := zrange(proxyBlockedSet, p.pool)
+	blockedProxies, err := zrange(p.keys.blockedSet(), p.pool)
 	if err != nil {
 		log.Error(err)
 		return nil, err
 	}
 
-	p.blockCache.Set(key, blockedProxies, defaultBlockCacheTTL)
+	p.blockCache.Set(key, blockedProxies, p.conf.BlockCacheTTL)
 	return blockedProxies, nil
 }
 
@@ -285,7 +384,7 @@ func (p *ProxyCenter) getAllProxyCacheKey() string {
 	return fmt.Sprint("allproxy")
 }
 
-func (p *ProxyCenter) getAllProxyKeys() ([]string, error) {
+func (p *ProxyCenter) getAllProxies() ([]string, error) {
 	p.mu.Lock()
 	defer p.mu.Unlock()
 
@@ -297,12 +396,12 @@ func (p *ProxyCenter) getAllProxyKeys() ([]string, error) {
 	}
 
 	// find all existing proxies in proxy_center
-	keys, err := getKeysByPattern(proxyPrefix+"*", p.pool)
+	proxies, err := getIndexedProxies(p.keys, p.pool)
 	if err != nil {
 		log.Error(err)
 		return nil, err
 	}
 
-	p.blockCache.Set(key, keys, defaultProxyCacheTTL)
-	return keys, nil
+	p.blockCache.Set(key, proxies, p.conf.ProxyCacheTTL)
+	return proxies, nil
 }
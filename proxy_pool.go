@@ -1,20 +1,21 @@
 package proxypool
 
 import (
+	"context"
+	"errors"
 	"fmt"
-	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/garyburd/redigo/redis"
 	"github.com/patrickmn/go-cache"
-	"github.com/seaguest/common/util"
 	"github.com/seaguest/log"
 )
 
 const (
 	defaultPoolBlockedCleanPeriod = time.Second * 60
-	defaultValidationPeriod       = time.Second * 60
+	defaultValidationPeriod       = time.Minute * 10
 	blockCacheTTL                 = time.Second * 1
 )
 
@@ -22,152 +23,326 @@ type ProxyPool struct {
 	// redis pool
 	pool *redis.Pool
 
+	// redis keys
+	keys keyspace
+
 	// channel name
 	channel string
 
+	// pool configuration, base from the configuration file and live one with the channel settings applied
+	base PoolConfig
+	conf atomic.Value
+
 	// cache holding the channel blocked proxy
 	blockCache *cache.Cache
 
-	// mutex for blocked_proxy
-	mu *sync.Mutex
+	// mutex for the refill in flight
+	mu        *sync.Mutex
+	refilling *refill
+
+	// handler of LowWater events
+	onLowWater func(LowWater)
+
+	// TakeContext calls waiting in this process
+	waits *waitQueue
+
+	// proxies leased ahead of time for Take
+	prefetch *prefetchBuffer
+
+	// background services
+	runner *runner
+
+	// time.Now, or the clock of a simulation
+	clock func() time.Time
 }
 
 // create proxy_pool for each channel
 func NewProxyPool(redisAddr, redisPassword string, channel string) *ProxyPool {
+	conf := DefaultConfig()
+	conf.Redis.Addr = redisAddr
+	conf.Redis.Password = redisPassword
+
+	pp, err := NewProxyPoolWithConfig(conf, channel)
+	if err != nil {
+		log.Error(err)
+		return nil
+	}
+	return pp
+}
+
+// create proxy_pool for the channel from configuration
+func NewProxyPoolWithConfig(conf *Config, channel string) (*ProxyPool, error) {
+	return newProxyPool(conf, channel, time.Now)
+}
+
+func newProxyPool(conf *Config, channel string, clock func() time.Time) (*ProxyPool, error) {
+	if channel == "" {
+		return nil, errors.New("empty channel name")
+	}
+	if err := conf.Validate(); err != nil {
+		return nil, err
+	}
+
 	pp := &ProxyPool{}
-	pp.pool = NewRedisPool(redisAddr, redisPassword)
+	pp.pool = NewRedisPoolWithConfig(&conf.Redis)
+	pp.keys = keyspace{conf.KeyPrefix}
 	pp.channel = channel
-	pp.blockCache = cache.New(blockCacheTTL, 0)
+	pp.base = conf.Pool
+	pp.conf.Store(&pp.base)
+	pp.blockCache = cache.New(pp.base.BlockCacheTTL, 0)
 	pp.mu = new(sync.Mutex)
+	pp.waits = newWaitQueue()
+	pp.prefetch = &prefetchBuffer{}
+	pp.runner = newRunner()
+	pp.clock = clock
+
+	// the settings of channel stored in redis, if any
+	if err := pp.loadSettings(); err != nil {
+		log.Error(err)
+	}
 
 	// start blocked proxy clean service
-	go pp.cleanBlockedProxy()
+	pp.runner.spawn(pp.cleanBlockedProxy)
+
+	// apply the changes of proxy center as they happen
+	pp.runner.spawn(pp.subscribe)
 
 	// validate proxy in proxy pool
-	go pp.validate()
-	return pp
+	pp.runner.spawn(pp.validate)
+
+	// reclaim abandoned leases
+	pp.runner.spawn(pp.reap)
+
+	// wake up the waiters of TakeContext
+	pp.runner.spawn(pp.dispatch)
+
+	// hand the proxies to the waiters as their cooldown ends
+	pp.runner.spawn(pp.cool)
+
+	// keep the channel above its minimum size
+	pp.runner.spawn(pp.watchLowWater)
+
+	// return the prefetched proxies before their lease expires
+	pp.runner.spawn(pp.sweepPrefetch)
+	return pp, nil
 }
 
-// take a proxy from proxy_pool, a proxy can be used only by one thread at the same time.
-func (p *ProxyPool) Take() *Member {
-	proxyPoolKey := getProxyPoolKey(p.channel)
-	proxy, err := zpop(proxyPoolKey, p.pool)
-	if err != nil {
-		log.Error(err)
+// block until ctx is done, then close the proxy pool.
+func (p *ProxyPool) Run(ctx context.Context) error {
+	<-ctx.Done()
+	return p.Close()
+}
+
+// stop all background services, return the prefetched proxies and close the redis pool, proxies taken should be freed before.
+func (p *ProxyPool) Close() error {
+	if !p.runner.stop() {
 		return nil
 	}
+	p.returnPrefetched(p.prefetch.drain(time.Time{}))
+	return p.pool.Close()
+}
 
-	// if no proxy available, reload
-	if proxy == nil {
-		p.mu.Lock()
-		defer p.mu.Unlock()
-
-		// find all existing proxies in proxy_center
-		keys, err := getKeysByPattern(proxyPrefix+"*", p.pool)
-		if err != nil {
-			log.Error(err)
-			return nil
+// take a proxy from proxy_pool, a proxy can be used by up to Concurrency threads at the same time.
+// the proxy is leased for LeaseTTL, it must be settled with Free or Delete before,
+// otherwise it is reclaimed and returned to proxy_pool.
+// with Prefetch set, the proxy comes from a local buffer leased in batches, with at least half its LeaseTTL left.
+func (p *ProxyPool) Take() *Member {
+	if p.config().Prefetch > 0 {
+		if proxy := p.takePrefetched(); proxy != nil {
+			return proxy
 		}
+	}
+	return p.TakeWith(nil)
+}
 
-		for _, key := range keys {
-			proxy := strings.TrimPrefix(key, proxyPrefix)
-			// if proxy is in the blocked pool, then skip
-			if p.isProxyBlocked(proxy) {
-				continue
-			}
-
-			proxyPoolKey := getProxyPoolKey(p.channel)
-			if err := zaddIncr(proxyPoolKey, proxy, 0, p.pool); err != nil {
-				log.Error(err)
-			}
-		}
+// when the proxy is used, then settle the lease and return it to proxy_pool
+func (p *ProxyPool) Free(proxy *Member) {
+	if isTunnel(proxy) {
+		return
+	}
 
-		// retry
-		proxy, err = zpop(proxyPoolKey, p.pool)
-		if err != nil {
+	if proxy.Lease == "" {
+		proxyPoolKey := p.keys.poolKey(p.channel)
+		if err := zaddIncr(proxyPoolKey, proxy.Member, int64(proxy.Score+1), p.pool); err != nil {
 			log.Error(err)
-			return nil
 		}
+		return
 	}
-	return proxy
-}
 
-// when the proxy is used, then return it to proxy_pool
-func (p *ProxyPool) Free(proxy *Member) {
-	proxyPoolKey := getProxyPoolKey(p.channel)
-	if err := zaddIncr(proxyPoolKey, proxy.Member, int64(proxy.Score+1), p.pool); err != nil {
+	p.learn(proxy.Member, true)
+
+	freed, err := p.freeLease(proxy, 1)
+	if err != nil {
 		log.Error(err)
+		return
+	}
+
+	if !freed {
+		log.Errorf("lease [%s] expired, proxy already reclaimed", proxy.Lease)
 	}
 }
 
-// when an ip is blocked , put it in blocked set AND delete it from pool, not return it,
+// when an ip is blocked, put it in blocked set AND delete it from pool, not return it,
+// the block stays local to the channel. a lease of the proxy is not settled, it is reclaimed once expired,
+// DeleteWithReason settles it at once.
 func (p *ProxyPool) Delete(proxy string) {
-	// add it to blocked pool
-	proxyBlockedKey := getProxyBlockedKey(p.channel)
-	ts := time.Now().Unix()
+	p.DeleteWithReason(&Member{Member: proxy}, BlockTarget)
+}
 
-	if err := zadd(proxyBlockedKey, proxy, ts, p.pool); err != nil {
-		log.Error(err)
+// block the proxy in channel like Delete, a BlockTarget reason also burns the proxy for the host it was taken for,
+// a BlockProxy reason is reported to proxy center,
+// which revalidates the proxy at once and removes it from every channel if it is dead.
+func (p *ProxyPool) DeleteWithReason(proxy *Member, reason BlockReason) {
+	if isTunnel(proxy) {
+		return
+	}
+
+	p.learn(proxy.Member, false)
+
+	if reason == BlockProxy {
+		p.shareFailure(proxy.Member)
+	} else {
+		p.burn(proxy)
 	}
+	p.strikeSubnet(proxy.Member)
 
-	// remove from pool
-	proxyPoolKey := getProxyPoolKey(p.channel)
-	if err := zrem(proxyPoolKey, proxy, p.pool); err != nil {
+	if err := p.deleteLease(proxy); err != nil {
 		log.Error(err)
 	}
 }
 
-// if a proxy is in blocked set longer than specified time, then delete it.
-func (p *ProxyPool) cleanBlockedProxy() {
+// if the block of a proxy in blocked set has ended, then delete it.
+func (p *ProxyPool) cleanBlockedProxy(ctx context.Context) {
 	for {
-		blockedProxies, err := p.getBlockedProxies()
-		if err != nil {
-			log.Error(err)
+		p.cleanBlocked()
+
+		if !sleep(ctx, p.config().BlockedCleanPeriod) {
 			return
 		}
+	}
+}
 
-		for _, blockedProxy := range blockedProxies {
-			if time.Now().Sub(time.Unix(int64(blockedProxy.Score), 0)) > defaultPoolBlockedCleanPeriod {
-				// if blocked_proxy xpires, clean it
-				proxyBlockedKey := getProxyBlockedKey(p.channel)
-				zrem(proxyBlockedKey, blockedProxy.Member, p.pool)
-			}
-		}
+func (p *ProxyPool) cleanBlocked() {
+	blockedProxies, err := p.getBlockedProxies()
+	if err != nil {
+		log.Error(err)
+	}
 
-		time.Sleep(defaultPoolBlockedCleanPeriod)
+	for _, blockedProxy := range blockedProxies {
+		if p.now().Unix() >= int64(blockedProxy.Score) {
+			// if blocked_proxy xpires, clean it
+			proxyBlockedKey := p.keys.poolBlockedKey(p.channel)
+			zrem(proxyBlockedKey, blockedProxy.Member, p.pool)
+		}
 	}
 }
 
 // check if all proxies in proxypool exist in proxycenter
-func (p *ProxyPool) validate() {
+func (p *ProxyPool) validate(ctx context.Context) {
 	for {
-		proxies, err := p.getProxies()
-		if err != nil {
+		if err := p.checkProxies(); err != nil {
 			log.Error(err)
-			return
 		}
 
-		// find all existing proxies in proxy_center
-		allProxiesKeys, err := getKeysByPattern(proxyPrefix+"*", p.pool)
-		if err != nil {
+		if err := p.loadSettings(); err != nil {
 			log.Error(err)
+		}
+
+		if !sleep(ctx, p.config().ValidationPeriod) {
 			return
 		}
+	}
+}
+
+// reconcile channel with proxy center: the proxies gone from proxy center are deleted like on their remove event,
+// and the proxies of proxy center missing from channel are added like on their add event, unless blocked or leased.
+func (p *ProxyPool) checkProxies() error {
+	proxies, err := zrange(p.keys.poolKey(p.channel), p.pool)
+	if err != nil {
+		return err
+	}
 
-		proxyBlockedKey := getProxyBlockedKey(p.channel)
-		for _, proxy := range proxies {
-			proxyKey := proxyPrefix + proxy.Member
-			if !util.ContainString(allProxiesKeys, proxyKey) {
-				// if proxy is not present in proxy center, then add it to blocked proxy
-				ts := time.Now().Unix()
+	// find all existing proxies in proxy_center
+	allProxies, err := getIndexedProxies(p.keys, p.pool)
+	if err != nil {
+		return err
+	}
+
+	existing := make(map[string]bool, len(allProxies))
+	for _, proxy := range allProxies {
+		existing[proxy] = true
+	}
+
+	// the leased proxies are blocked too, so that they are not freed back
+	leased, err := p.leasedProxies()
+	if err != nil {
+		return err
+	}
+
+	inChannel := make(map[string]bool, len(proxies)+len(leased))
+	for _, proxy := range proxies {
+		inChannel[proxy.Member] = true
+	}
+	for _, member := range leased {
+		inChannel[member] = true
+	}
+
+	for member := range inChannel {
+		if !existing[member] {
+			if err := p.deleteLease(&Member{Member: member}); err != nil {
+				log.Error(err)
+			}
+		}
+	}
 
-				if err := zadd(proxyBlockedKey, proxy.Member, ts, p.pool); err != nil {
-					log.Error(err)
-				}
+	for _, proxy := range allProxies {
+		if !inChannel[proxy] {
+			if err := p.addMember(proxy); err != nil {
+				log.Error(err)
 			}
 		}
-		time.Sleep(defaultValidationPeriod)
 	}
+
+	// forget the round robin position and rtt of proxies gone from proxy center
+	roundRobinKey := p.keys.poolRoundRobinKey(p.channel)
+	members, err := zrange(roundRobinKey, p.pool)
+	if err != nil {
+		return err
+	}
+
+	for _, member := range members {
+		if !existing[member.Member] {
+			if err := zrem(roundRobinKey, member.Member, p.pool); err != nil {
+				log.Error(err)
+			}
+			if err := p.forget(member.Member); err != nil {
+				log.Error(err)
+			}
+		}
+	}
+
+	rttKey := p.keys.poolRttKey(p.channel)
+	members, err = zrange(rttKey, p.pool)
+	if err != nil {
+		return err
+	}
+
+	for _, member := range members {
+		if !existing[member.Member] {
+			if err := zrem(rttKey, member.Member, p.pool); err != nil {
+				log.Error(err)
+			}
+		}
+	}
+	return nil
+}
+
+// proxies of channel with leases, some of them not in channel any longer
+func (p *ProxyPool) leasedProxies() ([]string, error) {
+	c := p.pool.Get()
+	defer c.Close()
+
+	return redis.Strings(c.Do("HKEYS", p.keys.poolLeasedKey(p.channel)))
 }
 
 func (p *ProxyPool) getBlockProxyCacheKey() string {
@@ -182,7 +357,7 @@ func (p *ProxyPool) getBlockedProxies() ([]*Member, error) {
 		return blockedIpItf.([]*Member), nil
 	}
 
-	proxyBlockedKey := getProxyBlockedKey(p.channel)
+	proxyBlockedKey := p.keys.poolBlockedKey(p.channel)
 	blockedProxies, err := zrange(proxyBlockedKey, p.pool)
 	if err != nil {
 		log.Error(err)
@@ -206,7 +381,7 @@ func (p *ProxyPool) getProxies() ([]*Member, error) {
 		return proxyItf.([]*Member), nil
 	}
 
-	proxyPoolKey := getProxyPoolKey(p.channel)
+	proxyPoolKey := p.keys.poolKey(p.channel)
 	proxies, err := zrange(proxyPoolKey, p.pool)
 	if err != nil {
 		log.Error(err)
@@ -216,18 +391,3 @@ func (p *ProxyPool) getProxies() ([]*Member, error) {
 	p.blockCache.SetDefault(key, proxies)
 	return proxies, nil
 }
-
-func (p *ProxyPool) isProxyBlocked(proxy string) bool {
-	blockedProxies, err := p.getBlockedProxies()
-	if err != nil {
-		log.Error(err)
-		return false
-	}
-
-	for _, blockedProxy := range blockedProxies {
-		if blockedProxy.Member == proxy {
-			return true
-		}
-	}
-	return false
-}
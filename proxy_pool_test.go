@@ -0,0 +1,102 @@
+package proxypool
+
+import (
+	"net"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/garyburd/redigo/redis"
+)
+
+// a proxy pool of channel on an in-memory redis, closed with the test.
+func newTestPool(t *testing.T, channel string, setup func(c *Config)) *ProxyPool {
+	t.Helper()
+
+	s := miniredis.RunT(t)
+	conf := DefaultConfig()
+	conf.KeyPrefix = "test_"
+	conf.Redis.Addr = s.Addr()
+	if setup != nil {
+		setup(conf)
+	}
+
+	pp, cleanup, err := newScratchPool(conf, channel, nil, time.Now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(cleanup)
+	return pp
+}
+
+// add the proxy to proxy center with the rtt given.
+func addTestProxy(t *testing.T, pp *ProxyPool, member string, rtt int) {
+	t.Helper()
+
+	ip, port, err := net.SplitHostPort(member)
+	if err != nil {
+		t.Fatal(err)
+	}
+	proxy := Proxy{Ip: ip, Port: port, Anonymity: AnonymityHigh, Rtt: rtt, ValidatedAt: pp.now().Unix()}
+	if err := saveProxy(&proxy, pp.keys, pp.pool); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestCheckProxies(t *testing.T) {
+	pp := newTestPool(t, "check", nil)
+	c := pp.pool.Get()
+	defer c.Close()
+
+	// changes of proxy center written without events, as if missed
+	write := func(cmds ...[]interface{}) {
+		t.Helper()
+		for _, cmd := range cmds {
+			c.Send(cmd[0].(string), cmd[1:]...)
+		}
+		if _, err := c.Do(""); err != nil {
+			t.Fatal(err)
+		}
+	}
+	index, channel := pp.keys.indexKey(), pp.keys.poolKey(pp.channel)
+
+	write([]interface{}{"ZADD", index, 1, "10.0.0.4:80"}, []interface{}{"ZADD", channel, 0, "10.0.0.4:80"})
+	leased := pp.Take()
+	if leased == nil {
+		t.Fatal("nothing taken")
+	}
+	write([]interface{}{"ZREM", index, "10.0.0.4:80"},
+		[]interface{}{"ZADD", index, 1, "10.0.0.1:80", 2, "10.0.0.3:80"},
+		[]interface{}{"ZADD", channel, 0, "10.0.0.1:80", 0, "10.0.0.2:80"})
+
+	if err := pp.checkProxies(); err != nil {
+		t.Fatal(err)
+	}
+	pp.Free(leased)
+
+	members, err := redis.Strings(c.Do("ZRANGE", channel, 0, -1))
+	if err != nil || !reflect.DeepEqual(members, []string{"10.0.0.1:80", "10.0.0.3:80"}) {
+		t.Errorf("channel holds %v, %v", members, err)
+	}
+	for _, member := range []string{"10.0.0.2:80", "10.0.0.4:80"} {
+		if _, err := redis.Int64(c.Do("ZSCORE", pp.keys.poolBlockedKey(pp.channel), member)); err != nil {
+			t.Errorf("%s not blocked, %v", member, err)
+		}
+	}
+}
+
+// wait for the add events of proxy center to bring channel to n members.
+func awaitChannel(t *testing.T, pp *ProxyPool, n int) {
+	t.Helper()
+
+	c := pp.pool.Get()
+	defer c.Close()
+
+	for deadline := time.Now().Add(time.Second); time.Now().Before(deadline); time.Sleep(time.Millisecond * 10) {
+		if got, err := redis.Int(c.Do("ZCARD", pp.keys.poolKey(pp.channel))); err != nil || got >= n {
+			return
+		}
+	}
+	t.Fatalf("channel below %d members", n)
+}
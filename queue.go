@@ -0,0 +1,467 @@
+package proxypool
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/garyburd/redigo/redis"
+	"github.com/seaguest/log"
+)
+
+const (
+	defaultMaxRoutine         = 500
+	defaultWorkerBatchSize    = 100
+	defaultWorkerBlockTimeout = time.Second * 5  // in seconds
+	defaultWorkerClaimIdle    = time.Second * 60 // in seconds
+	defaultWorkerClaimPeriod  = time.Second * 30 // in seconds
+	defaultWorkerMaxDelivery  = 3
+	defaultValidatingTTL      = time.Hour
+)
+
+// add the proxy to validation stream, unless it is already waiting or being validated.
+// a non-zero fencing token must match the current leader lease.
+var enqueueScript = redis.NewScript(3, `
+	if ARGV[3] ~= '0' and redis.call('GET', KEYS[3]) ~= ARGV[3] then
+	    return -1
+	end
+	if redis.call('ZADD', KEYS[2], 'NX', ARGV[2], ARGV[1]) == 1 then
+	    redis.call('XADD', KEYS[1], '*', 'proxy', ARGV[1])
+	    return 1
+	end
+	return 0`)
+
+// ack the stream entry and release the in-flight mark of the proxy.
+var ackScript = redis.NewScript(2, `
+	redis.call('XACK', KEYS[1], ARGV[1], ARGV[2])
+	redis.call('XDEL', KEYS[1], ARGV[2])
+	if ARGV[3] ~= '' then
+	    redis.call('ZREM', KEYS[2], ARGV[3])
+	end
+	return 1`)
+
+type streamEntry struct {
+	id    string
+	proxy string
+}
+
+type pendingEntry struct {
+	id         string
+	idle       time.Duration
+	deliveries int
+}
+
+// ValidationWorker consumes the validation queue stored in redis, any number of workers
+// can run on different hosts against the same redis.
+type ValidationWorker struct {
+	// redis pool
+	pool *redis.Pool
+
+	// redis keys
+	keys keyspace
+
+	// consumer name in the validation group
+	consumer string
+
+	// worker configuration
+	conf WorkerConfig
+
+	// entries read from stream waiting for validation
+	entryChan chan *streamEntry
+
+	// loops reading and claiming entries
+	runner *runner
+
+	// routines validating entries
+	wg sync.WaitGroup
+}
+
+// create a standalone validation worker
+func NewValidationWorker(redisAddr, redisPassword string, maxRoutine int) *ValidationWorker {
+	conf := DefaultConfig()
+	conf.Redis.Addr = redisAddr
+	conf.Redis.Password = redisPassword
+	if maxRoutine != 0 {
+		conf.Worker.MaxRoutine = maxRoutine
+	}
+
+	w, err := NewValidationWorkerWithConfig(conf)
+	if err != nil {
+		log.Error(err)
+		return nil
+	}
+	return w
+}
+
+// create a standalone validation worker from configuration
+func NewValidationWorkerWithConfig(conf *Config) (*ValidationWorker, error) {
+	if err := conf.Validate(); err != nil {
+		return nil, err
+	}
+
+	w := newValidationWorker(NewRedisPoolWithConfig(&conf.Redis), keyspace{conf.KeyPrefix}, conf.Worker)
+	w.start()
+	return w, nil
+}
+
+// block until ctx is done, then close the worker.
+func (w *ValidationWorker) Run(ctx context.Context) error {
+	<-ctx.Done()
+	return w.Close()
+}
+
+// stop reading the queue, wait for in-flight validations and close the redis pool.
+func (w *ValidationWorker) Close() error {
+	if !w.stop() {
+		return nil
+	}
+	return w.pool.Close()
+}
+
+func newValidationWorker(pool *redis.Pool, keys keyspace, conf WorkerConfig) *ValidationWorker {
+	w := &ValidationWorker{}
+	w.pool = pool
+	w.keys = keys
+	w.consumer = getConsumerName()
+	w.conf = conf
+	w.entryChan = make(chan *streamEntry, conf.BatchSize)
+	w.runner = newRunner()
+	return w
+}
+
+func getConsumerName() string {
+	host, err := os.Hostname()
+	if err != nil {
+		host = "unknown"
+	}
+	return fmt.Sprintf("%s-%d", host, os.Getpid())
+}
+
+func (w *ValidationWorker) start() {
+	for i := 0; i < w.conf.MaxRoutine; i++ {
+		w.wg.Add(1)
+		go func() {
+			defer w.wg.Done()
+			for entry := range w.entryChan {
+				w.process(entry)
+			}
+		}()
+	}
+
+	w.runner.spawn(w.consume)
+
+	// claim entries abandoned by dead workers
+	w.runner.spawn(w.reclaim)
+}
+
+// stop reading, then drain the entries already read, return false if already stopped.
+func (w *ValidationWorker) stop() bool {
+	if !w.runner.stop() {
+		return false
+	}
+
+	close(w.entryChan)
+	w.wg.Wait()
+	return true
+}
+
+func (w *ValidationWorker) consume(ctx context.Context) {
+	for {
+		err := createValidationGroup(w.keys, w.pool)
+		if err == nil {
+			break
+		}
+
+		log.Error(err)
+		if !sleep(ctx, time.Second) {
+			return
+		}
+	}
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		default:
+		}
+
+		entries, err := readValidationEntries(w.consumer, w.conf.BatchSize, w.keys, w.pool)
+		if err != nil {
+			log.Error(err)
+			if !sleep(ctx, time.Second) {
+				return
+			}
+			continue
+		}
+
+		if !w.dispatch(ctx, entries) {
+			return
+		}
+	}
+}
+
+// hand entries to validation routines, the entries left when ctx is done stay pending and will be claimed later.
+func (w *ValidationWorker) dispatch(ctx context.Context, entries []*streamEntry) bool {
+	for _, entry := range entries {
+		select {
+		case <-ctx.Done():
+			return false
+		case w.entryChan <- entry:
+		}
+	}
+	return true
+}
+
+func (w *ValidationWorker) process(entry *streamEntry) {
+	if entry.proxy != "" {
+		w.checkProxy(entry.proxy)
+	}
+
+	if err := ackValidation(entry, w.keys, w.pool); err != nil {
+		log.Error(err)
+	}
+}
+
+// retry the entries pending too long, drop them after too many deliveries.
+func (w *ValidationWorker) reclaim(ctx context.Context) {
+	ticker := time.NewTicker(w.conf.ClaimPeriod)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		pending, err := pendingValidationEntries(w.conf.BatchSize, w.keys, w.pool)
+		if err != nil {
+			log.Error(err)
+			continue
+		}
+
+		deliveries := make(map[string]int)
+		var ids []string
+		for _, pe := range pending {
+			if pe.idle < w.conf.ClaimIdle {
+				continue
+			}
+			deliveries[pe.id] = pe.deliveries
+			ids = append(ids, pe.id)
+		}
+
+		entries, err := claimValidationEntries(w.consumer, ids, w.conf.ClaimIdle, w.keys, w.pool)
+		if err != nil {
+			log.Error(err)
+			continue
+		}
+
+		var retries []*streamEntry
+		for _, entry := range entries {
+			if deliveries[entry.id] >= w.conf.MaxDelivery {
+				log.Errorf("drop proxy [%s] after [%d] deliveries", entry.proxy, deliveries[entry.id])
+				if err := ackValidation(entry, w.keys, w.pool); err != nil {
+					log.Error(err)
+				}
+				continue
+			}
+			retries = append(retries, entry)
+		}
+
+		if !w.dispatch(ctx, retries) {
+			return
+		}
+
+		// release in-flight marks whose entry has been lost
+		ts := time.Now().Add(-defaultValidatingTTL).Unix()
+		if err := zremRangeByScore(w.keys.validatingSet(), 0, ts, w.pool); err != nil {
+			log.Error(err)
+		}
+	}
+}
+
+// push proxies to validation queue, return the number of proxies really enqueued.
+// token is the fencing token of the leader, 0 to enqueue without fencing.
+func enqueueValidation(proxies []string, token int64, keys keyspace, pool *redis.Pool) (int, error) {
+	if len(proxies) == 0 {
+		return 0, nil
+	}
+
+	c := pool.Get()
+	defer c.Close()
+
+	if err := c.Err(); err != nil {
+		log.Error(err)
+		return 0, err
+	}
+
+	if err := enqueueScript.Load(c); err != nil {
+		log.Error(err)
+		return 0, err
+	}
+
+	ts := time.Now().Unix()
+	for _, proxy := range proxies {
+		if err := enqueueScript.SendHash(c, keys.validationStream(), keys.validatingSet(), keys.leaderKey(), proxy, ts, token); err != nil {
+			log.Error(err)
+			return 0, err
+		}
+	}
+	if err := c.Flush(); err != nil {
+		log.Error(err)
+		return 0, err
+	}
+
+	var count int
+	for range proxies {
+		added, err := redis.Int(c.Receive())
+		if err != nil {
+			log.Error(err)
+			return count, err
+		}
+		if added < 0 {
+			return count, errNotLeader
+		}
+		count += added
+	}
+	return count, nil
+}
+
+func createValidationGroup(keys keyspace, pool *redis.Pool) error {
+	c := pool.Get()
+	defer c.Close()
+
+	if err := c.Err(); err != nil {
+		return err
+	}
+
+	_, err := c.Do("XGROUP", "CREATE", keys.validationStream(), proxyValidationGroup, "0", "MKSTREAM")
+	if err != nil && strings.HasPrefix(err.Error(), "BUSYGROUP") {
+		// group already created by another worker
+		return nil
+	}
+	return err
+}
+
+func readValidationEntries(consumer string, count int, keys keyspace, pool *redis.Pool) ([]*streamEntry, error) {
+	c := pool.Get()
+	defer c.Close()
+
+	if err := c.Err(); err != nil {
+		return nil, err
+	}
+
+	reply, err := c.Do("XREADGROUP", "GROUP", proxyValidationGroup, consumer, "COUNT", count,
+		"BLOCK", int64(defaultWorkerBlockTimeout/time.Millisecond), "STREAMS", keys.validationStream(), ">")
+	if err != nil {
+		return nil, err
+	}
+
+	// nil reply when block timeout
+	if reply == nil {
+		return nil, nil
+	}
+
+	streams, err := redis.Values(reply, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	var entries []*streamEntry
+	for _, stream := range streams {
+		kv, err := redis.Values(stream, nil)
+		if err != nil || len(kv) != 2 {
+			return nil, fmt.Errorf("unexpected stream reply [%v]", stream)
+		}
+
+		items, err := redis.Values(kv[1], nil)
+		if err != nil {
+			return nil, err
+		}
+		entries = append(entries, parseStreamEntries(items)...)
+	}
+	return entries, nil
+}
+
+func parseStreamEntries(items []interface{}) []*streamEntry {
+	var entries []*streamEntry
+	for _, item := range items {
+		fields, err := redis.Values(item, nil)
+		// entry deleted before claimed
+		if err != nil || len(fields) != 2 {
+			continue
+		}
+
+		var entry streamEntry
+		entry.id, _ = redis.String(fields[0], nil)
+		values, _ := redis.StringMap(fields[1], nil)
+		entry.proxy = values["proxy"]
+		entries = append(entries, &entry)
+	}
+	return entries
+}
+
+func pendingValidationEntries(count int, keys keyspace, pool *redis.Pool) ([]*pendingEntry, error) {
+	c := pool.Get()
+	defer c.Close()
+
+	if err := c.Err(); err != nil {
+		return nil, err
+	}
+
+	items, err := redis.Values(c.Do("XPENDING", keys.validationStream(), proxyValidationGroup, "-", "+", count))
+	if err != nil {
+		return nil, err
+	}
+
+	var pending []*pendingEntry
+	for _, item := range items {
+		fields, err := redis.Values(item, nil)
+		if err != nil || len(fields) != 4 {
+			continue
+		}
+
+		var pe pendingEntry
+		pe.id, _ = redis.String(fields[0], nil)
+		idle, _ := redis.Int64(fields[2], nil)
+		pe.idle = time.Duration(idle) * time.Millisecond
+		pe.deliveries, _ = redis.Int(fields[3], nil)
+		pending = append(pending, &pe)
+	}
+	return pending, nil
+}
+
+func claimValidationEntries(consumer string, ids []string, minIdle time.Duration, keys keyspace, pool *redis.Pool) ([]*streamEntry, error) {
+	if len(ids) == 0 {
+		return nil, nil
+	}
+
+	c := pool.Get()
+	defer c.Close()
+
+	if err := c.Err(); err != nil {
+		return nil, err
+	}
+
+	args := redis.Args{}.Add(keys.validationStream(), proxyValidationGroup, consumer,
+		int64(minIdle/time.Millisecond)).AddFlat(ids)
+	items, err := redis.Values(c.Do("XCLAIM", args...))
+	if err != nil {
+		return nil, err
+	}
+	return parseStreamEntries(items), nil
+}
+
+func ackValidation(entry *streamEntry, keys keyspace, pool *redis.Pool) error {
+	c := pool.Get()
+	defer c.Close()
+
+	if err := c.Err(); err != nil {
+		return err
+	}
+
+	_, err := ackScript.Do(c, keys.validationStream(), keys.validatingSet(), proxyValidationGroup, entry.id, entry.proxy)
+	return err
+}
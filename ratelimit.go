@@ -0,0 +1,89 @@
+package proxypool
+
+import "errors"
+
+const (
+	defaultTargetBurst = 1
+)
+
+// eligibility of a member for selection, after the cooldown following Free, the bans of the target host,
+// the proxy-level failures reported to proxy center, the global concurrency, the diversity of the channel
+// and the rate limit of the target host.
+// KEYS: 9 cooldown; ARGV: 2 proxy key prefix, 18 now in milliseconds, 19 bucket key prefix of the target host or empty,
+// 20 rate per second, 21 burst, 22 burn key of the target host or empty, 29 proxy failure limit, 0 for none,
+// 30 and after the members to skip
+const readyLua = `
+	-- members already taken by the script or by the caller, so that a batch take hands out distinct proxies
+	local picked = {}
+	for i = 30, #ARGV do
+	    picked[ARGV[i]] = true
+	end
+
+	-- token bucket of member for the target host, refilled up to now, nil if not limited.
+	local function bucket(member)
+	    if ARGV[19] == '' then
+	        return nil
+	    end
+	    local key = ARGV[19] .. member
+	    local now, rate, burst = tonumber(ARGV[18]), tonumber(ARGV[20]), tonumber(ARGV[21])
+	    local b = redis.call('HMGET', key, 'tokens', 'ts')
+	    local tokens = tonumber(b[1]) or burst
+	    local ts = tonumber(b[2]) or now
+	    return key, math.min(burst, tokens + (now - ts) * rate / 1000)
+	end
+
+	local function ready(member)
+	    if picked[member] then
+	        return false
+	    end
+	    local ends = redis.call('ZSCORE', KEYS[9], member)
+	    if ends and tonumber(ends) > tonumber(ARGV[18]) then
+	        return false
+	    end
+	    if ARGV[22] ~= '' then
+	        local burnt = redis.call('ZSCORE', ARGV[22], member)
+	        if burnt and tonumber(burnt) > tonumber(ARGV[18]) then
+	            return false
+	        end
+	    end
+	    local limit = tonumber(ARGV[29])
+	    if limit > 0 and tonumber(redis.call('HGET', ARGV[2] .. member, 'failures') or '0') >= limit then
+	        return false
+	    end
+	    if not shared(member) or not diverse(member) then
+	        return false
+	    end
+	    local key, tokens = bucket(member)
+	    return not key or tokens >= 1
+	end
+
+	-- take a token of member for the target host, the bucket expires once full again.
+	local function consume(member)
+	    local key, tokens = bucket(member)
+	    if key then
+	        redis.call('HMSET', key, 'tokens', tokens - 1, 'ts', ARGV[18])
+	        redis.call('PEXPIRE', key, math.ceil((tonumber(ARGV[21]) - tokens + 1) * 1000 / tonumber(ARGV[20])))
+	    end
+	end
+`
+
+// key prefix of the token buckets of the target host, empty if the channel does not limit it.
+func (p *ProxyPool) bucketPrefix(host string) string {
+	if host == "" || p.config().TargetRate <= 0 {
+		return ""
+	}
+	return p.keys.poolBucketPrefix(p.channel, host)
+}
+
+func validRateLimit(c *PoolConfig) error {
+	if c.Cooldown < 0 {
+		return errors.New("pool cooldown must not be negative")
+	}
+	if c.TargetRate < 0 {
+		return errors.New("pool target_rate must not be negative")
+	}
+	if c.TargetBurst <= 0 {
+		return errors.New("pool target_burst must be positive")
+	}
+	return nil
+}
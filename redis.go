@@ -11,22 +11,37 @@ import (
 type Member struct {
 	Member string `json:"member"`
 	Score  int    `json:"score"`
-}
 
-func containsMember(members []*Member, proxy string) bool {
-	for _, mem := range members {
-		if mem.Member == proxy {
-			return true
-		}
-	}
-	return false
+	// lease id given by Take, to settle with Free or Delete
+	Lease string `json:"lease"`
+
+	// target host given by the take, a ban of the proxy burns it for this host
+	Host string `json:"host,omitempty"`
 }
 
+const (
+	defaultRedisMaxIdle     = 50
+	defaultRedisIdleTimeout = time.Second * 240
+)
+
 // 获取redis连接池对象
 func NewRedisPool(address, password string) *redis.Pool {
+	return NewRedisPoolWithConfig(&RedisConfig{
+		Addr:        address,
+		Password:    password,
+		MaxIdle:     defaultRedisMaxIdle,
+		IdleTimeout: defaultRedisIdleTimeout,
+	})
+}
+
+// 根据配置获取redis连接池对象
+func NewRedisPoolWithConfig(conf *RedisConfig) *redis.Pool {
+	address := conf.Addr
+	password := conf.Password
 	pool := &redis.Pool{
-		MaxIdle:     50,
-		IdleTimeout: 240 * time.Second,
+		MaxIdle:     conf.MaxIdle,
+		MaxActive:   conf.MaxActive,
+		IdleTimeout: conf.IdleTimeout,
 		TestOnBorrow: func(c redis.Conn, t time.Time) error {
 			_, err := c.Do("PING")
 			return err
@@ -52,36 +67,37 @@ func dial(network, address, password string) (redis.Conn, error) {
 	return c, err
 }
 
-func getKeysByPattern(pattern string, pool *redis.Pool) ([]string, error) {
+// iterate the keys matching the pattern with SCAN, batch by batch, without blocking redis like KEYS.
+func scanKeys(pattern string, pool *redis.Pool, fn func(keys []string) error) error {
 	conn := pool.Get()
 	defer conn.Close()
 
 	if err := conn.Err(); err != nil {
-		return []string{}, err
+		return err
 	}
 
-	data, err := redis.Strings(conn.Do("KEYS", pattern))
-	return data, err
-}
-
-func setObject(key string, value interface{}, pool *redis.Pool) error {
-	conn := pool.Get()
-	defer conn.Close()
+	cursor := 0
+	for {
+		values, err := redis.Values(conn.Do("SCAN", cursor, "MATCH", pattern, "COUNT", 1000))
+		if err != nil {
+			return err
+		}
 
-	var err error
-	if err := conn.Err(); err != nil {
-		log.Error(err)
-		return err
-	}
+		cursor, _ = redis.Int(values[0], nil)
+		keys, _ := redis.Strings(values[1], nil)
+		if len(keys) > 0 {
+			if err := fn(keys); err != nil {
+				return err
+			}
+		}
 
-	if _, err = conn.Do("HMSET", redis.Args{}.Add(key).AddFlat(value)...); err != nil {
-		log.Error(err)
-		return err
+		if cursor == 0 {
+			return nil
+		}
 	}
-	return nil
 }
 
-func getObject(key string, value interface{}, pool *redis.Pool) error {
+func setObject(key string, value interface{}, pool *redis.Pool) error {
 	conn := pool.Get()
 	defer conn.Close()
 
@@ -91,51 +107,11 @@ func getObject(key string, value interface{}, pool *redis.Pool) error {
 		return err
 	}
 
-	v, err := redis.Values(conn.Do("HGETALL", key))
-	if err != nil {
-		log.Error(err)
-		return err
-	}
-
-	if err := redis.ScanStruct(v, value); err != nil {
+	if _, err = conn.Do("HMSET", redis.Args{}.Add(key).AddFlat(value)...); err != nil {
 		log.Error(err)
 		return err
 	}
-	return err
-}
-
-func zpop(key string, pool *redis.Pool) (*Member, error) {
-	c := pool.Get()
-	defer c.Close()
-
-	var err error
-	if err := c.Err(); err != nil {
-		log.Error(err)
-		return nil, err
-	}
-
-	var zpopScript = redis.NewScript(1, `
-	    local r = redis.call('ZREVRANGE', KEYS[1], 0, 0, "WITHSCORES")
-	    if r ~= nil then
-	        local  k = r[1]
-	        redis.call('ZREM', KEYS[1], k)
-	    end
-	    return r`)
-	v, _ := redis.Strings(zpopScript.Do(c, key))
-	if err != nil {
-		log.Error(err)
-		return nil, err
-	}
-
-	// return nil if no record found
-	if len(v) == 0 {
-		return nil, nil
-	}
-
-	var proxy Member
-	proxy.Member = v[0]
-	proxy.Score, _ = strconv.Atoi(v[1])
-	return &proxy, nil
+	return nil
 }
 
 func zrange(key string, pool *redis.Pool) ([]*Member, error) {
@@ -188,7 +164,7 @@ func zrem(key, member string, pool *redis.Pool) error {
 	return err
 }
 
-func zaddIncr(key, value string, score int64, pool *redis.Pool) error {
+func zremRangeByScore(key string, min, max int64, pool *redis.Pool) error {
 	c := pool.Get()
 	defer c.Close()
 
@@ -198,36 +174,22 @@ func zaddIncr(key, value string, score int64, pool *redis.Pool) error {
 		return err
 	}
 
-	_, err = c.Do("ZADD", key, "INCR", score, value)
+	_, err = c.Do("ZREMRANGEBYSCORE", key, min, max)
 	return err
 }
 
-func zrank(key, value string, pool *redis.Pool) (interface{}, error) {
+func zaddIncr(key, value string, score int64, pool *redis.Pool) error {
 	c := pool.Get()
 	defer c.Close()
 
 	var err error
 	if err := c.Err(); err != nil {
 		log.Error(err)
-		return nil, err
-	}
-
-	data, err := c.Do("ZRANK", key, value)
-	return data, err
-}
-
-func zexists(key, value string, pool *redis.Pool) bool {
-	val, err := zrank(key, value, pool)
-
-	if err != nil {
-		log.Error(err)
-		return false
+		return err
 	}
 
-	if val == nil {
-		return false
-	}
-	return true
+	_, err = c.Do("ZADD", key, "INCR", score, value)
+	return err
 }
 
 func exists(key string, pool *redis.Pool) bool {
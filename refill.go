@@ -0,0 +1,149 @@
+package proxypool
+
+import (
+	"fmt"
+	"math/rand"
+	"time"
+
+	"github.com/garyburd/redigo/redis"
+	"github.com/seaguest/log"
+)
+
+const (
+	refillLockTTL     = time.Second * 10       // in seconds, shortened to refillMinInterval once the refill is done
+	refillMinInterval = time.Millisecond * 500 // in milliseconds, misses within it do not refill again
+	refillWait        = time.Second * 2        // in seconds, max wait for the refill of another process
+	refillPoll        = time.Millisecond * 50  // in milliseconds
+	refillDone        = "done"                 // value of the lock kept after a refill
+	refillChunk       = 500                    // proxies of proxy_center added per script call
+)
+
+// add a chunk of the proxies of proxy_center to channel from offset, except the blocked and leased ones,
+// keeping the scores of the members already in channel, then wake up as many waiters as members added so that they retry.
+// nothing is done unless the lock is still held, nor unless channel is empty for the first chunk,
+// misses with members left come from cooldowns, bans or criteria.
+// return the number of proxies read from proxy_center, the refill is done once below the chunk size.
+// KEYS: 7 waiters, 8 blocked, 9 index, 10 rtt, 11 lock;
+// ARGV: 7 now, 8 wake prefix, 9 alive prefix, 10 lock token, 11 offset, 12 chunk size, 13 lock ttl in milliseconds
+var refillScript = redis.NewScript(11, leaseLua+`
+	if redis.call('GET', KEYS[11]) ~= ARGV[10] then
+	    return 0
+	end
+	local offset = tonumber(ARGV[11])
+	if offset == 0 and redis.call('ZCARD', KEYS[1]) > 0 then
+	    return 0
+	end
+	redis.call('PEXPIRE', KEYS[11], ARGV[13])
+
+	local members = redis.call('ZRANGE', KEYS[9], offset, offset + tonumber(ARGV[12]) - 1)
+	local added = 0
+	for _, member in ipairs(members) do
+	    if not redis.call('ZSCORE', KEYS[8], member) and not redis.call('HGET', KEYS[4], member) then
+	        added = added + redis.call('ZADD', KEYS[1], 'NX', 0, member)
+	        -- new members come first in round robin
+	        redis.call('ZADD', KEYS[6], 'NX', 0, member)
+	        local rtt = redis.call('HGET', ARGV[2] .. member, 'rtt')
+	        if rtt then
+	            redis.call('ZADD', KEYS[10], rtt, member)
+	        end
+	    end
+	end
+
+	local n = 0
+	while n < added and handoff(KEYS[7], nil, 0, ARGV[7], ARGV[8], ARGV[9]) do
+	    n = n + 1
+	end
+	return #members`)
+
+// keep the lock of the refill done for the min interval, so that the misses meanwhile do not refill again.
+// KEYS: 1 lock; ARGV: 1 token, 2 done value, 3 min interval in milliseconds
+var refillDoneScript = redis.NewScript(1, `
+	if redis.call('GET', KEYS[1]) == ARGV[1] then
+	    return redis.call('SET', KEYS[1], ARGV[2], 'PX', ARGV[3])
+	end
+	return 0`)
+
+// a refill in flight in this process
+type refill struct {
+	done chan struct{}
+}
+
+// refill channel from proxy_center if it is empty, once at a time across all processes sharing channel,
+// and at most once per refillMinInterval.
+// concurrent callers wait for the refill in flight, up to refillWait if it runs in another process.
+func (p *ProxyPool) reload() {
+	p.mu.Lock()
+	if r := p.refilling; r != nil {
+		p.mu.Unlock()
+		<-r.done
+		return
+	}
+	r := &refill{done: make(chan struct{})}
+	p.refilling = r
+	p.mu.Unlock()
+
+	defer func() {
+		p.mu.Lock()
+		p.refilling = nil
+		p.mu.Unlock()
+		close(r.done)
+	}()
+
+	if err := p.refill(); err != nil {
+		log.Error(err)
+	}
+}
+
+func (p *ProxyPool) refill() error {
+	c := p.pool.Get()
+	defer c.Close()
+
+	if err := c.Err(); err != nil {
+		return err
+	}
+
+	lockKey := p.keys.poolRefillLockKey(p.channel)
+	token := fmt.Sprintf("%s-%x", p.waits.proc, rand.Int63())
+	_, err := redis.String(c.Do("SET", lockKey, token, "NX", "PX", int64(refillLockTTL/time.Millisecond)))
+	if err == redis.ErrNil {
+		return p.awaitRefill(c, lockKey)
+	}
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if _, err := refillDoneScript.Do(c, lockKey, token, refillDone, int64(refillMinInterval/time.Millisecond)); err != nil {
+			log.Error(err)
+		}
+	}()
+
+	// the proxies indexed meanwhile may be missed or read twice, they are added by their events anyway
+	args := p.leaseArgs(p.keys.poolWaitersKey(p.channel), p.keys.poolBlockedKey(p.channel), p.keys.indexKey(),
+		p.keys.poolRttKey(p.channel), lockKey)
+	for offset := 0; ; offset += refillChunk {
+		n, err := redis.Int(refillScript.Do(c, args.Add(p.nowMillis(), p.keys.poolWakePrefix(p.channel),
+			p.keys.poolAlivePrefix(p.channel), token, offset, refillChunk, int64(refillLockTTL/time.Millisecond))...))
+		if err != nil || n < refillChunk {
+			return err
+		}
+	}
+}
+
+// wait for the refill of another process to be done, or for refillWait.
+func (p *ProxyPool) awaitRefill(c redis.Conn, lockKey string) error {
+	deadline := time.Now().Add(refillWait)
+	for time.Now().Before(deadline) {
+		v, err := redis.String(c.Do("GET", lockKey))
+		if err == redis.ErrNil || v == refillDone {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+
+		if !sleep(p.runner.ctx, refillPoll) {
+			return errPoolClosed
+		}
+	}
+	return nil
+}
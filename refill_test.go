@@ -0,0 +1,41 @@
+package proxypool
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/garyburd/redigo/redis"
+)
+
+func TestRefillInChunks(t *testing.T) {
+	pp := newTestPool(t, "refill", nil)
+
+	// indexed without events, so that only the refill adds them
+	n := refillChunk*2 + 10
+	c := pp.pool.Get()
+	defer c.Close()
+	for i := 0; i < n; i++ {
+		member := fmt.Sprintf("10.0.%d.%d:80", i/250, i%250)
+		c.Send("ZADD", pp.keys.indexKey(), i, member)
+		c.Send("HSET", pp.keys.proxyPrefix()+member, "rtt", i)
+	}
+	c.Send("ZADD", pp.keys.poolBlockedKey(pp.channel), pp.blockEnd(), "10.0.0.0:80")
+	if _, err := c.Do(""); err != nil {
+		t.Fatal(err)
+	}
+
+	pp.reload()
+	for key, want := range map[string]int{
+		pp.keys.poolKey(pp.channel):    n - 1,
+		pp.keys.poolRttKey(pp.channel): n - 1,
+	} {
+		if got, err := redis.Int(c.Do("ZCARD", key)); err != nil || got != want {
+			t.Errorf("%s holds %d members, want %d, %v", key, got, want, err)
+		}
+	}
+
+	// the lock is kept for the min interval once done
+	if v, err := redis.String(c.Do("GET", pp.keys.poolRefillLockKey(pp.channel))); err != nil || v != refillDone {
+		t.Errorf("refill lock is %q, %v", v, err)
+	}
+}
@@ -0,0 +1,165 @@
+package proxypool
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/garyburd/redigo/redis"
+	"github.com/seaguest/log"
+)
+
+const (
+	defaultStrikeLimit    = 3
+	defaultMaxBlockPeriod = time.Hour * 1 // in hours
+)
+
+// Outcome of the use of a proxy, given to Report.
+type Outcome int
+
+const (
+	// the request succeeded
+	OutcomeSuccess Outcome = iota
+
+	// the request succeeded, but the proxy was slow
+	OutcomeSlow
+
+	// the request failed, e.g. a timeout or a bad status, the proxy may still be fine
+	OutcomeSoftFailure
+
+	// the target banned the proxy or answered with a captcha, a hard failure
+	OutcomeBanned
+
+	// the proxy refused the connection or is gone, a hard failure
+	OutcomeDead
+)
+
+// class of an outcome in reportScript
+const (
+	outcomeClassOther   = 0
+	outcomeClassSuccess = 1
+	outcomeClassHard    = 2
+)
+
+type outcomeEffect struct {
+	// change of the health score, kept within 1 and defaultHealthWeight
+	health int
+	class  int
+
+	// the failure comes from the proxy itself, not from the target of the channel
+	reason BlockReason
+}
+
+var outcomeEffects = map[Outcome]outcomeEffect{
+	OutcomeSuccess:     {10, outcomeClassSuccess, BlockTarget},
+	OutcomeSlow:        {-5, outcomeClassOther, BlockTarget},
+	OutcomeSoftFailure: {-15, outcomeClassOther, BlockTarget},
+	OutcomeBanned:      {-30, outcomeClassHard, BlockTarget},
+	OutcomeDead:        {-50, outcomeClassHard, BlockProxy},
+}
+
+func (o Outcome) String() string {
+	switch o {
+	case OutcomeSuccess:
+		return "success"
+	case OutcomeSlow:
+		return "slow"
+	case OutcomeSoftFailure:
+		return "soft_failure"
+	case OutcomeBanned:
+		return "banned"
+	case OutcomeDead:
+		return "dead"
+	}
+	return fmt.Sprintf("outcome(%d)", int(o))
+}
+
+// adjust the health of the member, count its hard failures in a row, then settle the lease.
+// the member is blocked once it reaches the strike limit, for the base period doubled at each block
+// since it was last fully healthy, and returned to channel otherwise.
+// return 1 if the member was blocked.
+// KEYS: 7 waiters, 8 blocked, 9 cooldown, 10 health, 11 strikes, 12 offences;
+// ARGV: 7 lease, 8 member, 9 incr, 10 now, 11 wake prefix, 12 alive prefix, 13 cooldown,
+// 14 health change, 15 outcome class, 16 max health, 17 strike limit, 18 base block in seconds, 19 max block in seconds
+var reportScript = redis.NewScript(12, leaseLua+settleLua+`
+	local member = ARGV[8]
+	local max = tonumber(ARGV[16])
+	local health = tonumber(redis.call('HGET', KEYS[10], member) or max) + tonumber(ARGV[14])
+	health = math.max(1, math.min(max, health))
+	redis.call('HSET', KEYS[10], member, health)
+
+	local blocked = 0
+	if ARGV[15] == '2' then
+	    if redis.call('HINCRBY', KEYS[11], member, 1) >= tonumber(ARGV[17]) then
+	        redis.call('HDEL', KEYS[11], member)
+	        local n = redis.call('HINCRBY', KEYS[12], member, 1)
+	        local d = math.min(tonumber(ARGV[19]), tonumber(ARGV[18]) * 2 ^ (n - 1))
+	        redis.call('ZADD', KEYS[8], math.floor(tonumber(ARGV[10]) / 1000 + d), member)
+	        redis.call('ZREM', KEYS[1], member)
+	        blocked = 1
+	    end
+	elseif ARGV[15] == '1' then
+	    redis.call('HDEL', KEYS[11], member)
+	    if health >= max then
+	        redis.call('HDEL', KEYS[12], member)
+	    end
+	end
+
+	local score = release(ARGV[7], member)
+	if score and blocked == 0 then
+	    settle(member, score, tonumber(ARGV[9]), ARGV[10], ARGV[11], ARGV[12], ARGV[13])
+	end
+	return blocked`)
+
+// settle the lease of a proxy taken from proxy_pool with the outcome of its use, instead of Free or Delete.
+// the outcome adjusts the health of the proxy used by StrategyWeightedRandom, only StrikeLimit hard failures
+// in a row block the proxy, for longer each time it is blocked again before recovering full health.
+// OutcomeDead is shared with proxy center like a Delete with BlockProxy.
+func (p *ProxyPool) Report(proxy *Member, outcome Outcome) {
+	if isTunnel(proxy) {
+		return
+	}
+
+	effect, found := outcomeEffects[outcome]
+	if !found {
+		log.Errorf("unknown outcome [%s] for proxy [%s]", outcome, proxy.Member)
+		return
+	}
+
+	p.learn(proxy.Member, effect.class == outcomeClassSuccess || outcome == OutcomeSlow)
+
+	if effect.reason == BlockProxy {
+		p.shareFailure(proxy.Member)
+	} else if effect.class == outcomeClassHard {
+		p.burn(proxy)
+	}
+	if effect.class == outcomeClassHard {
+		p.strikeSubnet(proxy.Member)
+	}
+
+	blocked, err := p.reportLease(proxy, effect)
+	if err != nil {
+		log.Error(err)
+		return
+	}
+
+	if blocked {
+		log.Errorf("proxy [%s] blocked in channel [%s] after [%d] hard failures", proxy.Member, p.channel, p.config().StrikeLimit)
+	}
+}
+
+func (p *ProxyPool) reportLease(proxy *Member, effect outcomeEffect) (bool, error) {
+	c := p.pool.Get()
+	defer c.Close()
+
+	if err := c.Err(); err != nil {
+		return false, err
+	}
+
+	args := p.leaseArgs(p.keys.poolWaitersKey(p.channel), p.keys.poolBlockedKey(p.channel), p.keys.poolCooldownKey(p.channel),
+		p.keys.poolHealthKey(p.channel), p.keys.poolStrikesKey(p.channel), p.keys.poolOffencesKey(p.channel)).
+		Add(proxy.Lease, proxy.Member, 1, p.nowMillis(), p.keys.poolWakePrefix(p.channel), p.keys.poolAlivePrefix(p.channel),
+			int64(p.config().Cooldown/time.Millisecond)).
+		Add(effect.health, effect.class, defaultHealthWeight, p.config().StrikeLimit,
+			int64(p.config().BlockedCleanPeriod/time.Second), int64(p.config().MaxBlockPeriod/time.Second))
+	return redis.Bool(reportScript.Do(c, args...))
+}
@@ -0,0 +1,80 @@
+package proxypool
+
+import (
+	"net"
+	"time"
+
+	"github.com/garyburd/redigo/redis"
+	"github.com/seaguest/log"
+)
+
+// BlockReason tells whether a failure is specific to the target of the channel or comes from the proxy itself.
+type BlockReason int
+
+const (
+	defaultBurnTTL           = time.Minute * 30 // in minutes
+	defaultProxyFailureLimit = 2
+)
+
+const (
+	// banned or rejected by the target of the channel, the proxy may be fine for other channels
+	BlockTarget BlockReason = iota
+
+	// the proxy is dead or broken, whatever the target
+	BlockProxy
+)
+
+// burn the member for the host until now + ttl, dropping the burns ended.
+// KEYS: 1 burns of the host; ARGV: 1 member, 2 now in milliseconds, 3 ttl in milliseconds
+var burnScript = redis.NewScript(1, `
+	local now = tonumber(ARGV[2])
+	redis.call('ZREMRANGEBYSCORE', KEYS[1], '-inf', now)
+	redis.call('ZADD', KEYS[1], now + tonumber(ARGV[3]), ARGV[1])
+	redis.call('PEXPIRE', KEYS[1], ARGV[3])
+	return 1`)
+
+// burn the proxy for the host it was taken for during BurnTTL, in every channel.
+func (p *ProxyPool) burn(proxy *Member) {
+	if proxy.Host == "" {
+		return
+	}
+
+	c := p.pool.Get()
+	defer c.Close()
+
+	if _, err := burnScript.Do(c, p.burnArgs(proxy)...); err != nil {
+		log.Error(err)
+	}
+}
+
+func (p *ProxyPool) burnArgs(proxy *Member) redis.Args {
+	return redis.Args{}.Add(p.keys.burnKey(proxy.Host), proxy.Member, p.nowMillis(), int64(p.config().BurnTTL/time.Millisecond))
+}
+
+// report a proxy-level failure to proxy center and have the proxy revalidated at once.
+// until then, every channel skips the proxy once it reaches its ProxyFailureLimit.
+// if it is dead, the validation removes it from proxy center, and the channels drop it on the remove event,
+// otherwise the validation clears its failures.
+func (p *ProxyPool) shareFailure(member string) {
+	ip, port, err := net.SplitHostPort(member)
+	if err != nil {
+		log.Errorf("invalid proxy [%s]", member)
+		return
+	}
+
+	failures, err := addProxyFailure(ip, port, p.keys, p.pool)
+	if err != nil {
+		log.Error(err)
+		return
+	}
+
+	// already removed from proxy center
+	if failures == 0 {
+		return
+	}
+
+	// any process may enqueue without fencing token, the validating set dedupes
+	if _, err := enqueueValidation([]string{member}, 0, p.keys, p.pool); err != nil {
+		log.Error(err)
+	}
+}
@@ -0,0 +1,65 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"time"
+
+	"github.com/seaguest/log"
+	"github.com/seaguest/proxypool"
+)
+
+// evaluate the selection strategies offline on a simulated clock, against an in-memory redis.
+// outcomes are replayed in order from a log of {"proxy", "outcome", "latency_ms", "time_ms"} lines,
+// or drawn from a synthetic population.
+func main() {
+	path := flag.String("config", "", "yaml or json config file, for pool settings")
+	strategies := flag.String("strategies", "", "comma separated strategies, all if empty")
+	takes := flag.Int("takes", 0, "takes per strategy, 0 for the length of the log, or 10000 with a synthetic population")
+	step := flag.Duration("step", time.Second, "simulated time between two takes without recorded time")
+	seed := flag.Int64("seed", 1, "random seed")
+	logPath := flag.String("log", "", "recorded outcomes to replay, a synthetic population is used if empty")
+
+	pop := proxypool.DefaultSimulationPopulation()
+	flag.IntVar(&pop.Proxies, "proxies", pop.Proxies, "synthetic proxies")
+	flag.Float64Var(&pop.MinSuccess, "min-success", pop.MinSuccess, "min success rate of a synthetic proxy")
+	flag.Float64Var(&pop.MaxSuccess, "max-success", pop.MaxSuccess, "max success rate of a synthetic proxy")
+	flag.Float64Var(&pop.BanRate, "ban-rate", pop.BanRate, "probability of a ban on each use")
+	flag.Float64Var(&pop.DeathRate, "death-rate", pop.DeathRate, "probability of a proxy dying on each use")
+	flag.DurationVar(&pop.MeanLatency, "latency", pop.MeanLatency, "mean latency of the synthetic proxies")
+	flag.Parse()
+
+	conf, err := proxypool.LoadConfig(*path)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	if err := conf.LoadEnv(); err != nil {
+		log.Fatal(err)
+	}
+
+	sim := &proxypool.SimulationConfig{
+		Config:     conf,
+		Strategies: proxypool.ParseStrategies(*strategies),
+		Takes:      *takes,
+		Step:       *step,
+		Seed:       *seed,
+		Population: pop,
+	}
+
+	if *logPath != "" {
+		if sim.Log, err = proxypool.LoadSimulationLog(*logPath); err != nil {
+			log.Fatal(err)
+		}
+	} else if sim.Takes == 0 {
+		sim.Takes = 10000
+	}
+
+	results, err := proxypool.Simulate(sim)
+	for _, result := range results {
+		fmt.Println(result)
+	}
+	if err != nil {
+		log.Fatal(err)
+	}
+}
@@ -0,0 +1,467 @@
+package proxypool
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"math"
+	"math/rand"
+	"net"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/garyburd/redigo/redis"
+	"github.com/seaguest/log"
+)
+
+const (
+	defaultSimulationStep = time.Second * 1 // in seconds
+	simulationMaintenance = time.Minute * 1 // in minutes, of simulated time
+)
+
+// SimulationConfig describes an offline evaluation of selection strategies.
+// each strategy runs the real ProxyPool and its scripts on a simulated clock, against an in-memory redis
+// of its own, so that no redis server is needed and no deployment is ever touched.
+type SimulationConfig struct {
+	// pool settings, the strategy is set per run and the redis settings are ignored
+	Config *Config
+
+	Strategies []string
+
+	// takes per strategy, the length of the log if zero when replaying
+	Takes int
+
+	// simulated time between two takes, for records without time and synthetic populations
+	Step time.Duration
+
+	// random seed, the same seed replays the same outcomes for a given choice of proxies
+	Seed int64
+
+	// recorded outcomes to replay, see LoadSimulationLog, a synthetic population is used if nil
+	Log []SimulationRecord
+
+	// synthetic population
+	Population SimulationPopulation
+}
+
+// SimulationPopulation is a synthetic proxy population, each proxy draws its success rate
+// uniformly within MinSuccess and MaxSuccess, and its mean latency around MeanLatency.
+type SimulationPopulation struct {
+	Proxies    int
+	MinSuccess float64
+	MaxSuccess float64
+
+	// probability of a ban on each use, and of the proxy dying for good
+	BanRate   float64
+	DeathRate float64
+
+	MeanLatency time.Duration
+}
+
+// SimulationRecord is a recorded use of a proxy, one json object per line in a simulation log, in the order of the takes.
+type SimulationRecord struct {
+	Proxy   string `json:"proxy"`
+	Outcome string `json:"outcome"`
+	Latency int    `json:"latency_ms"`
+
+	// unix time of the take in milliseconds, optional
+	Time int64 `json:"time_ms,omitempty"`
+}
+
+// SimulationResult sums up the run of a strategy.
+type SimulationResult struct {
+	Strategy string
+	Takes    int
+
+	// takes answered with no proxy
+	Misses int
+
+	// success or slow outcomes over the takes answered
+	SuccessRate float64
+
+	// share of takes handing a different proxy than the previous take, and distinct proxies used
+	Churn    float64
+	Distinct int
+
+	// proxies blocked in channel during the run
+	Blocked int
+
+	LatencyP50 time.Duration
+	LatencyP90 time.Duration
+	LatencyP99 time.Duration
+}
+
+func (r *SimulationResult) String() string {
+	return fmt.Sprintf("%-16s takes=%d misses=%d success=%.3f churn=%.3f distinct=%d blocked=%d p50=%s p90=%s p99=%s",
+		r.Strategy, r.Takes, r.Misses, r.SuccessRate, r.Churn, r.Distinct, r.Blocked, r.LatencyP50, r.LatencyP90, r.LatencyP99)
+}
+
+// default synthetic population
+func DefaultSimulationPopulation() SimulationPopulation {
+	return SimulationPopulation{
+		Proxies:     200,
+		MinSuccess:  0.3,
+		MaxSuccess:  0.99,
+		BanRate:     0.02,
+		DeathRate:   0.002,
+		MeanLatency: time.Millisecond * 800,
+	}
+}
+
+// load a simulation log, one SimulationRecord per line.
+func LoadSimulationLog(path string) ([]SimulationRecord, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var records []SimulationRecord
+	scanner := bufio.NewScanner(f)
+	for line := 1; scanner.Scan(); line++ {
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" {
+			continue
+		}
+
+		var record SimulationRecord
+		if err := json.Unmarshal([]byte(text), &record); err != nil {
+			return nil, fmt.Errorf("simulation log line [%d]: %v", line, err)
+		}
+		if _, err := parseOutcome(record.Outcome); err != nil {
+			return nil, fmt.Errorf("simulation log line [%d]: %v", line, err)
+		}
+		records = append(records, record)
+	}
+	return records, scanner.Err()
+}
+
+func parseOutcome(s string) (Outcome, error) {
+	for outcome := range outcomeEffects {
+		if outcome.String() == s {
+			return outcome, nil
+		}
+	}
+	return 0, fmt.Errorf("unknown outcome [%s]", s)
+}
+
+// clock of a simulation, moved forward by the takes
+type simulationClock struct {
+	mu sync.Mutex
+	t  time.Time
+}
+
+func (c *simulationClock) now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.t
+}
+
+// move the clock to t, never backwards
+func (c *simulationClock) set(t time.Time) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if t.After(c.t) {
+		c.t = t
+	}
+}
+
+func (c *simulationClock) advance(d time.Duration) {
+	c.set(c.now().Add(d))
+}
+
+// outcome model of the simulated proxies
+type simulationModel interface {
+	proxies() []string
+	use(member string, rnd *rand.Rand) (Outcome, time.Duration)
+}
+
+// replays the recorded outcomes of each proxy in the order of the log.
+// the n-th take of a proxy gets its n-th recorded outcome, starting over once all of them were replayed.
+type replayModel struct {
+	records map[string][]SimulationRecord
+	next    map[string]int
+}
+
+func newReplayModel(log []SimulationRecord) *replayModel {
+	m := &replayModel{records: make(map[string][]SimulationRecord), next: make(map[string]int)}
+	for _, record := range log {
+		m.records[record.Proxy] = append(m.records[record.Proxy], record)
+	}
+	return m
+}
+
+func (m *replayModel) proxies() []string {
+	var members []string
+	for member := range m.records {
+		members = append(members, member)
+	}
+	sort.Strings(members)
+	return members
+}
+
+func (m *replayModel) use(member string, rnd *rand.Rand) (Outcome, time.Duration) {
+	records := m.records[member]
+	record := records[m.next[member]%len(records)]
+	m.next[member]++
+	outcome, _ := parseOutcome(record.Outcome)
+	return outcome, time.Duration(record.Latency) * time.Millisecond
+}
+
+type syntheticProxy struct {
+	success float64
+	latency time.Duration
+	dead    bool
+}
+
+// draws the outcomes from the synthetic population
+type syntheticModel struct {
+	pop     SimulationPopulation
+	members []string
+	state   map[string]*syntheticProxy
+}
+
+func newSyntheticModel(pop SimulationPopulation, rnd *rand.Rand) *syntheticModel {
+	m := &syntheticModel{pop: pop, state: make(map[string]*syntheticProxy)}
+	for i := 0; i < pop.Proxies; i++ {
+		member := fmt.Sprintf("10.%d.%d.%d:8080", i>>16&255, i>>8&255, i&255)
+		m.members = append(m.members, member)
+		m.state[member] = &syntheticProxy{
+			success: pop.MinSuccess + rnd.Float64()*(pop.MaxSuccess-pop.MinSuccess),
+			latency: time.Duration(float64(pop.MeanLatency) * math.Exp(rnd.NormFloat64()*0.5)),
+		}
+	}
+	return m
+}
+
+func (m *syntheticModel) proxies() []string {
+	return m.members
+}
+
+func (m *syntheticModel) use(member string, rnd *rand.Rand) (Outcome, time.Duration) {
+	p := m.state[member]
+	latency := time.Duration(rnd.ExpFloat64() * float64(p.latency))
+	if p.dead {
+		return OutcomeDead, latency
+	}
+
+	r := rnd.Float64()
+	switch {
+	case r < m.pop.DeathRate:
+		p.dead = true
+		return OutcomeDead, latency
+	case r < m.pop.DeathRate+m.pop.BanRate:
+		return OutcomeBanned, latency
+	case rnd.Float64() >= p.success:
+		return OutcomeSoftFailure, latency
+	case latency > 2*m.pop.MeanLatency:
+		return OutcomeSlow, latency
+	}
+	return OutcomeSuccess, latency
+}
+
+// run every strategy of the simulation, in order. conf is left untouched, the defaults apply to a copy.
+func Simulate(conf *SimulationConfig) ([]*SimulationResult, error) {
+	sim := *conf
+	if sim.Takes == 0 && sim.Log != nil {
+		sim.Takes = len(sim.Log)
+	}
+	if sim.Takes <= 0 {
+		return nil, fmt.Errorf("simulation takes must be positive, got [%d]", sim.Takes)
+	}
+	if sim.Step <= 0 {
+		sim.Step = defaultSimulationStep
+	}
+	for _, strategy := range sim.Strategies {
+		if err := validStrategy(strategy); err != nil {
+			return nil, err
+		}
+	}
+
+	var results []*SimulationResult
+	for _, strategy := range sim.Strategies {
+		result, err := simulateStrategy(&sim, strategy)
+		if err != nil {
+			return results, err
+		}
+		results = append(results, result)
+	}
+	return results, nil
+}
+
+func simulateStrategy(conf *SimulationConfig, strategy string) (*SimulationResult, error) {
+	rnd := rand.New(rand.NewSource(conf.Seed))
+
+	var model simulationModel
+	if conf.Log != nil {
+		model = newReplayModel(conf.Log)
+	} else {
+		model = newSyntheticModel(conf.Population, rnd)
+	}
+
+	// the clock starts at the first record when the log has times
+	clock := &simulationClock{t: time.Now()}
+	if len(conf.Log) > 0 && conf.Log[0].Time > 0 {
+		clock.t = time.Unix(0, conf.Log[0].Time*int64(time.Millisecond))
+	}
+
+	// an in-memory redis per run, its ttls follow the simulated clock
+	s, err := miniredis.Run()
+	if err != nil {
+		return nil, err
+	}
+	defer s.Close()
+
+	c := *conf.Config
+	c.KeyPrefix = fmt.Sprintf("%ssim_%s_", conf.Config.KeyPrefix, strategy)
+	c.Redis = RedisConfig{Addr: s.Addr(), MaxIdle: defaultRedisMaxIdle, IdleTimeout: defaultRedisIdleTimeout}
+	c.Pool.Strategy = strategy
+	c.Pool.FallbackTunnel = ""
+
+	pp, cleanup, err := newScratchPool(&c, "simulation", model.proxies(), clock.now)
+	if err != nil {
+		return nil, err
+	}
+	defer cleanup()
+
+	result := &SimulationResult{Strategy: strategy, Takes: conf.Takes}
+	used := make(map[string]bool)
+	var latencies []time.Duration
+	var succeeded, switched int
+	var previous string
+
+	maintained := clock.now()
+	for i := 0; i < conf.Takes; i++ {
+		before := clock.now()
+		if i < len(conf.Log) && conf.Log[i].Time > 0 {
+			clock.set(time.Unix(0, conf.Log[i].Time*int64(time.Millisecond)))
+		} else if i > 0 {
+			clock.advance(conf.Step)
+		}
+		s.FastForward(clock.now().Sub(before))
+
+		// blocks end on the simulated clock, not on the one of the background loops
+		if clock.now().Sub(maintained) >= simulationMaintenance {
+			pp.cleanBlocked()
+			maintained = clock.now()
+		}
+
+		proxy := pp.Take()
+		if proxy == nil {
+			result.Misses++
+			continue
+		}
+
+		outcome, latency := model.use(proxy.Member, rnd)
+		if outcome == OutcomeSuccess || outcome == OutcomeSlow {
+			succeeded++
+		}
+		if previous != "" && proxy.Member != previous {
+			switched++
+		}
+		previous = proxy.Member
+		used[proxy.Member] = true
+		latencies = append(latencies, latency)
+
+		pp.Report(proxy, outcome)
+	}
+
+	answered := conf.Takes - result.Misses
+	if answered > 0 {
+		result.SuccessRate = float64(succeeded) / float64(answered)
+		result.Churn = float64(switched) / float64(answered)
+	}
+	result.Distinct = len(used)
+
+	blocked, err := zrange(pp.keys.poolBlockedKey(pp.channel), pp.pool)
+	if err != nil {
+		return nil, err
+	}
+	result.Blocked = len(blocked)
+
+	sort.Slice(latencies, func(i, j int) bool { return latencies[i] < latencies[j] })
+	result.LatencyP50 = percentile(latencies, 0.5)
+	result.LatencyP90 = percentile(latencies, 0.9)
+	result.LatencyP99 = percentile(latencies, 0.99)
+	return result, nil
+}
+
+// create a proxy pool for the channel with the proxies given as ip:port added to proxy center, for simulations
+// and benchmarks. the key prefix of conf must be a scratch keyspace of its own, dropped by cleanup,
+// which stops the background loops first and closes the pool.
+func newScratchPool(conf *Config, channel string, members []string, clock func() time.Time) (*ProxyPool, func(), error) {
+	pp, err := newProxyPool(conf, channel, clock)
+	if err != nil {
+		return nil, nil, err
+	}
+	cleanup := func() {
+		pp.runner.stop()
+		if err := dropKeyspace(pp.keys, pp.pool); err != nil {
+			log.Error(err)
+		}
+		pp.pool.Close()
+	}
+
+	for _, member := range members {
+		ip, port, err := net.SplitHostPort(member)
+		if err != nil {
+			cleanup()
+			return nil, nil, fmt.Errorf("invalid proxy [%s]", member)
+		}
+
+		proxy := Proxy{Ip: ip, Port: port, Anonymity: AnonymityHigh, ValidatedAt: clock().Unix()}
+		if err := saveProxy(&proxy, pp.keys, pp.pool); err != nil {
+			cleanup()
+			return nil, nil, err
+		}
+	}
+	return pp, cleanup, nil
+}
+
+func percentile(sorted []time.Duration, q float64) time.Duration {
+	if len(sorted) == 0 {
+		return 0
+	}
+	i := int(math.Ceil(q*float64(len(sorted)))) - 1
+	if i < 0 {
+		i = 0
+	}
+	return sorted[i]
+}
+
+// delete every key of the keyspace, it must have a prefix of its own.
+func dropKeyspace(keys keyspace, pool *redis.Pool) error {
+	if keys.prefix == "" {
+		return fmt.Errorf("refusing to drop the keyspace without prefix")
+	}
+
+	return scanKeys(keys.prefix+"*", pool, func(batch []string) error {
+		c := pool.Get()
+		defer c.Close()
+
+		_, err := c.Do("DEL", redis.Args{}.AddFlat(batch)...)
+		return err
+	})
+}
+
+// parse a comma separated list of strategies, all of them if empty.
+func ParseStrategies(list string) []string {
+	if strings.TrimSpace(list) == "" {
+		var all []string
+		for name := range strategyScripts {
+			all = append(all, name)
+		}
+		sort.Strings(all)
+		return all
+	}
+
+	var strategies []string
+	for _, name := range strings.Split(list, ",") {
+		strategies = append(strategies, strings.TrimSpace(name))
+	}
+	return strategies
+}
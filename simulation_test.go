@@ -0,0 +1,84 @@
+package proxypool
+
+import (
+	"fmt"
+	"math/rand"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestReplayModelUse(t *testing.T) {
+	m := newReplayModel([]SimulationRecord{
+		{Proxy: "a:1", Outcome: "success", Latency: 10},
+		{Proxy: "b:1", Outcome: "dead", Latency: 20},
+		{Proxy: "a:1", Outcome: "banned", Latency: 30},
+		{Proxy: "a:1", Outcome: "slow", Latency: 40},
+	})
+	rnd := rand.New(rand.NewSource(1))
+
+	tests := []struct {
+		member  string
+		outcome Outcome
+		latency time.Duration
+	}{
+		// each proxy replays its own records in order, then starts over
+		{"a:1", OutcomeSuccess, 10 * time.Millisecond},
+		{"a:1", OutcomeBanned, 30 * time.Millisecond},
+		{"b:1", OutcomeDead, 20 * time.Millisecond},
+		{"a:1", OutcomeSlow, 40 * time.Millisecond},
+		{"a:1", OutcomeSuccess, 10 * time.Millisecond},
+		{"b:1", OutcomeDead, 20 * time.Millisecond},
+	}
+	for i, tt := range tests {
+		outcome, latency := m.use(tt.member, rnd)
+		if outcome != tt.outcome || latency != tt.latency {
+			t.Errorf("take %d of %s = %s %s, want %s %s", i, tt.member, outcome, latency, tt.outcome, tt.latency)
+		}
+	}
+
+	if got := m.proxies(); len(got) != 2 || got[0] != "a:1" || got[1] != "b:1" {
+		t.Errorf("proxies = %v", got)
+	}
+}
+
+func TestSimulate(t *testing.T) {
+	var records []SimulationRecord
+	for i := 0; i < 50; i++ {
+		outcome := "success"
+		if i%5 == 4 {
+			outcome = "banned"
+		}
+		records = append(records, SimulationRecord{Proxy: fmt.Sprintf("10.0.0.%d:80", i%5), Outcome: outcome, Latency: 100})
+	}
+
+	tests := []struct {
+		name  string
+		conf  SimulationConfig
+		takes int
+	}{
+		{"replay", SimulationConfig{Log: records}, len(records)},
+		{"synthetic", SimulationConfig{Takes: 100, Population: DefaultSimulationPopulation()}, 100},
+	}
+	for _, tt := range tests {
+		tt.conf.Config = DefaultConfig()
+		tt.conf.Strategies = []string{StrategyLeastUsed, StrategyRoundRobin}
+		conf := tt.conf
+
+		results, err := Simulate(&conf)
+		if err != nil {
+			t.Fatalf("%s: %v", tt.name, err)
+		}
+		if !reflect.DeepEqual(conf, tt.conf) {
+			t.Errorf("%s: configuration modified", tt.name)
+		}
+		if len(results) != 2 {
+			t.Fatalf("%s: %d results", tt.name, len(results))
+		}
+		for _, result := range results {
+			if result.Takes != tt.takes || result.Misses == result.Takes || result.Distinct == 0 {
+				t.Errorf("%s: %s", tt.name, result)
+			}
+		}
+	}
+}
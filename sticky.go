@@ -0,0 +1,156 @@
+package proxypool
+
+import (
+	"errors"
+	"time"
+
+	"github.com/garyburd/redigo/redis"
+	"github.com/seaguest/log"
+)
+
+const (
+	stickyBindRetry = 3
+	stickyBusyPoll  = time.Millisecond * 50 // in milliseconds
+)
+
+// lease the proxy bound to the session and extend the session, even if cooling down,
+// but only within its concurrency in channel and its share of the global concurrency.
+// return {} if no proxy is bound, {member} if the bound proxy was blocked in channel or deleted from proxy center,
+// or burnt for the target host, {member, 'busy'} if it is leased up to its limits by others.
+// KEYS: 7 session, 8 blocked; ARGV: 7 session ttl in milliseconds, 8 burn key of the target host or empty, 9 now in milliseconds
+var stickyScript = redis.NewScript(8, leaseLua+`
+	local member = redis.call('GET', KEYS[7])
+	if not member then
+	    return {}
+	end
+	if redis.call('ZSCORE', KEYS[8], member) or redis.call('EXISTS', ARGV[2] .. member) == 0 then
+	    return {member}
+	end
+	if ARGV[8] ~= '' then
+	    local burnt = redis.call('ZSCORE', ARGV[8], member)
+	    if burnt and tonumber(burnt) > tonumber(ARGV[9]) then
+	        return {member}
+	    end
+	end
+	redis.call('PEXPIRE', KEYS[7], ARGV[7])
+	if not (available(member) and shared(member)) then
+	    return {member, 'busy'}
+	end
+	return lease(member, redis.call('ZSCORE', KEYS[1], member) or 0)`)
+
+// bind the session to the member unless another worker rebound it meanwhile.
+// KEYS: 1 session; ARGV: 1 member bound before or empty, 2 member, 3 session ttl in milliseconds
+var bindScript = redis.NewScript(1, `
+	local current = redis.call('GET', KEYS[1])
+	if (current or '') ~= ARGV[1] then
+	    return 0
+	end
+	redis.call('SET', KEYS[1], ARGV[2], 'PX', ARGV[3])
+	return 1`)
+
+// take the proxy bound to the session, so that a multi-step flow keeps the same exit ip across workers.
+// the session is bound to a proxy chosen by the channel strategy on first use and expires after ttl without take.
+// when the bound proxy is deleted or blocked, the session fails over to a new proxy and switched is true.
+// when it is leased up to its concurrency by others, the session waits up to WaitRetryPeriod, then fails over too.
+// like Take, the proxy must be settled with Free or Delete, nil if none is available.
+func (p *ProxyPool) TakeSticky(sessionKey string, ttl time.Duration) (proxy *Member, switched bool) {
+	return p.TakeStickyWith(sessionKey, ttl, nil)
+}
+
+// take the proxy bound to the session like TakeSticky, the session is bound to a proxy matching the criteria,
+// and fails over when its proxy is burnt for the target host.
+func (p *ProxyPool) TakeStickyWith(sessionKey string, ttl time.Duration, criteria *Criteria) (proxy *Member, switched bool) {
+	if sessionKey == "" || ttl <= 0 {
+		log.Error(errors.New("sticky session needs a key and a positive ttl"))
+		return nil, false
+	}
+
+	busyUntil := time.Now().Add(p.config().WaitRetryPeriod)
+	for i := 0; i < stickyBindRetry; {
+		proxy, bound, busy, err := p.takeSession(sessionKey, ttl, criteria)
+		if err != nil {
+			log.Error(err)
+			return nil, false
+		}
+		if proxy != nil {
+			if criteria != nil {
+				proxy.Host = criteria.Host
+			}
+			return proxy, false
+		}
+
+		// keep the exit ip while the bound proxy may be freed soon
+		if busy && time.Now().Before(busyUntil) {
+			if !sleep(p.runner.ctx, stickyBusyPoll) {
+				return nil, false
+			}
+			continue
+		}
+
+		proxy = p.TakeWith(criteria)
+		if proxy == nil || isTunnel(proxy) {
+			// the session stays bound until a proxy of channel is available
+			return proxy, false
+		}
+
+		ok, err := p.bindSession(sessionKey, bound, proxy.Member, ttl)
+		if err != nil {
+			log.Error(err)
+			p.Free(proxy)
+			return nil, false
+		}
+		if ok {
+			if bound != "" {
+				log.Errorf("session [%s] of channel [%s] switched from [%s] to [%s]", sessionKey, p.channel, bound, proxy.Member)
+			}
+			return proxy, bound != ""
+		}
+
+		// another worker bound the session meanwhile, use its proxy
+		p.Free(proxy)
+		i++
+	}
+	return nil, false
+}
+
+// lease the proxy bound to the session, nil with the proxy bound before if it must be replaced,
+// and busy if it is leased up to its limits by others.
+func (p *ProxyPool) takeSession(sessionKey string, ttl time.Duration, criteria *Criteria) (*Member, string, bool, error) {
+	c := p.pool.Get()
+	defer c.Close()
+
+	if err := c.Err(); err != nil {
+		return nil, "", false, err
+	}
+
+	var burnKey string
+	if criteria != nil && criteria.Host != "" {
+		burnKey = p.keys.burnKey(criteria.Host)
+	}
+
+	args := p.leaseArgs(p.keys.poolSessionKey(p.channel, sessionKey), p.keys.poolBlockedKey(p.channel)).
+		Add(int64(ttl/time.Millisecond), burnKey, p.nowMillis())
+	reply, err := redis.Values(stickyScript.Do(c, args...))
+	if err != nil {
+		return nil, "", false, err
+	}
+
+	if len(reply) == 1 || len(reply) == 2 {
+		bound, err := redis.String(reply[0], nil)
+		return nil, bound, len(reply) == 2, err
+	}
+
+	proxy, err := parseLease(reply, nil)
+	return proxy, "", false, err
+}
+
+func (p *ProxyPool) bindSession(sessionKey, bound, member string, ttl time.Duration) (bool, error) {
+	c := p.pool.Get()
+	defer c.Close()
+
+	if err := c.Err(); err != nil {
+		return false, err
+	}
+
+	return redis.Bool(bindScript.Do(c, p.keys.poolSessionKey(p.channel, sessionKey), bound, member, int64(ttl/time.Millisecond)))
+}
@@ -0,0 +1,292 @@
+package proxypool
+
+import (
+	"fmt"
+	"math/rand"
+	"strings"
+	"time"
+
+	"github.com/garyburd/redigo/redis"
+)
+
+const (
+	defaultSelectionScanLimit = 500
+	defaultHealthWeight       = 100
+	selectionScanBatch        = 50
+)
+
+// selection strategies of a channel
+const (
+	// the proxy with the highest score, i.e. the most used one, kept for compatibility
+	StrategyMostUsed = "most_used"
+
+	// the proxy with the lowest score, i.e. the least used one
+	StrategyLeastUsed = "least_used"
+
+	// the proxy taken the longest time ago
+	StrategyRoundRobin = "round_robin"
+
+	// the proxy with the lowest validation rtt
+	StrategyFastest = "fastest"
+
+	// a random proxy, weighted by its health score in channel
+	StrategyWeightedRandom = "weighted_random"
+
+	// Thompson sampling on the decayed successes and failures of the proxies in channel
+	StrategyBandit = "bandit"
+)
+
+// check a member against the criteria, reading only the fields needed from its proxy hash.
+// ARGV: 2 proxy key prefix, 10 criteria set, 11 min anonymity, 12 max rtt, 13 country, 14 region, 15 protocols, 16 labels
+const matchLua = `
+	local function has(list, item)
+	    return string.find(',' .. (list or '') .. ',', ',' .. item .. ',', 1, true) ~= nil
+	end
+
+	local function match(member)
+	    if ARGV[10] == '0' then
+	        return true
+	    end
+	    local f = redis.call('HMGET', ARGV[2] .. member, 'anonymity', 'rtt', 'https', 'protocols', 'country', 'region', 'labels')
+	    if not f[1] then
+	        return false
+	    end
+	    if tonumber(f[1]) < tonumber(ARGV[11]) then
+	        return false
+	    end
+	    if tonumber(ARGV[12]) > 0 and tonumber(f[2] or 0) > tonumber(ARGV[12]) then
+	        return false
+	    end
+	    if ARGV[13] ~= '' and f[5] ~= ARGV[13] then
+	        return false
+	    end
+	    if ARGV[14] ~= '' and f[6] ~= ARGV[14] then
+	        return false
+	    end
+	    for protocol in string.gmatch(ARGV[15], '[^,]+') do
+	        if not (has(f[4], protocol) or (protocol == 'https' and f[3] == '1')) then
+	            return false
+	        end
+	    end
+	    for label in string.gmatch(ARGV[16], '[^,]+') do
+	        if not has(f[7], label) then
+	            return false
+	        end
+	    end
+	    return true
+	end
+
+	-- first matching member of channel walking the ordering zset in batches, up to the scan limit.
+	-- with prune, the members neither in channel nor leased are dropped from the ordering zset on the way.
+	local function first(key, reverse, prune)
+	    local limit = tonumber(ARGV[7])
+	    local batch = tonumber(ARGV[8])
+	    local start = 0
+	    while start < limit do
+	        local r
+	        if reverse then
+	            r = redis.call('ZREVRANGE', key, start, start + batch - 1)
+	        else
+	            r = redis.call('ZRANGE', key, start, start + batch - 1)
+	        end
+	        if #r == 0 then
+	            return nil
+	        end
+	        for _, member in ipairs(r) do
+	            local score = redis.call('ZSCORE', KEYS[1], member)
+	            if score and ready(member) and match(member) then
+	                return member, score
+	            end
+	            if prune and not score and not redis.call('HGET', KEYS[4], member) then
+	                redis.call('ZREM', key, member)
+	            end
+	        end
+	        start = start + batch
+	    end
+	    return nil
+	end
+`
+
+// each strategy defines pick(), returning the member and its score in channel, or nil.
+// KEYS: 6 roundrobin, 7 rtt, 8 health, 9 cooldown, 10 bandit, 11 recent groups, 12 blocked subnets;
+// ARGV: 7 scan limit, 8 scan batch, 17 default health weight, 18 now, 23 bandit half-life, 24 explore rate
+var strategyLua = map[string]string{
+	StrategyMostUsed: `
+	local function pick()
+	    return first(KEYS[1], true)
+	end`,
+
+	StrategyLeastUsed: `
+	local function pick()
+	    return first(KEYS[1], false)
+	end`,
+
+	StrategyRoundRobin: `
+	local function pick()
+	    local member, score = first(KEYS[6], false)
+	    if member then
+	        return member, score
+	    end
+	    -- members never taken are not in the round robin set yet
+	    return first(KEYS[1], false)
+	end`,
+
+	StrategyFastest: `
+	local function pick()
+	    local member, score = first(KEYS[7], false, true)
+	    if member then
+	        return member, score
+	    end
+	    return first(KEYS[1], false)
+	end`,
+
+	StrategyWeightedRandom: `
+	local function pick()
+	    local r = redis.call('ZRANGE', KEYS[1], 0, tonumber(ARGV[7]) - 1, 'WITHSCORES')
+	    local members, scores, weights, total = {}, {}, {}, 0
+	    for i = 1, #r, 2 do
+	        if ready(r[i]) and match(r[i]) then
+	            local w = tonumber(redis.call('HGET', KEYS[8], r[i]) or ARGV[17])
+	            if w > 0 then
+	                table.insert(members, r[i])
+	                table.insert(scores, r[i + 1])
+	                table.insert(weights, w)
+	                total = total + w
+	            end
+	        end
+	    end
+	    if total == 0 then
+	        return nil
+	    end
+	    local x = math.random() * total
+	    for i, w in ipairs(weights) do
+	        x = x - w
+	        if x <= 0 then
+	            return members[i], scores[i]
+	        end
+	    end
+	    return members[#members], scores[#scores]
+	end`,
+
+	StrategyBandit: banditLua + `
+	local function pick()
+	    local r = redis.call('ZRANGE', KEYS[1], 0, tonumber(ARGV[7]) - 1, 'WITHSCORES')
+	    local members, scores, fresh = {}, {}, {}
+	    local best, bestTheta = nil, -1
+	    for i = 1, #r, 2 do
+	        if ready(r[i]) and match(r[i]) then
+	            table.insert(members, r[i])
+	            table.insert(scores, r[i + 1])
+	            local s, f = counts(r[i])
+	            if s + f < 1 then
+	                table.insert(fresh, #members)
+	            end
+	            local theta = beta(s + 1, f + 1)
+	            if theta > bestTheta then
+	                best, bestTheta = #members, theta
+	            end
+	        end
+	    end
+	    if not best then
+	        return nil
+	    end
+	    -- explore the proxies barely seen, or any proxy once all are known
+	    if math.random() < tonumber(ARGV[24]) then
+	        if #fresh > 0 then
+	            best = fresh[math.random(#fresh)]
+	        else
+	            best = math.random(#members)
+	        end
+	    end
+	    return members[best], scores[best]
+	end`,
+}
+
+// one atomic selection script per strategy
+var strategyScripts = make(map[string]*redis.Script)
+
+func init() {
+	rand.Seed(time.Now().UnixNano())
+
+	for name, pick := range strategyLua {
+		strategyScripts[name] = redis.NewScript(12, leaseLua+diversityLua+readyLua+matchLua+pick+`
+	math.randomseed(tonumber(ARGV[9]))
+	local taken = {}
+	for i = 1, tonumber(ARGV[28]) do
+	    local member, score = pick()
+	    if not member and ARGV[25] ~= '' and not relaxed then
+	        relaxed = true
+	        member, score = pick()
+	    end
+	    if not member then
+	        break
+	    end
+	    picked[member] = true
+	    consume(member)
+	    remember(member)
+	    for _, v in ipairs(lease(member, score)) do
+	        table.insert(taken, v)
+	    end
+	end
+	return taken`)
+	}
+}
+
+func validStrategy(strategy string) error {
+	if _, found := strategyScripts[strategy]; !found {
+		return fmt.Errorf("unknown selection strategy [%s]", strategy)
+	}
+	return nil
+}
+
+// lease a proxy chosen by the channel strategy among the ones matching the criteria, nil if none.
+func (p *ProxyPool) selectLease(criteria *Criteria) (*Member, error) {
+	proxies, err := p.selectLeases(criteria, 1, nil)
+	if err != nil || len(proxies) == 0 {
+		return nil, err
+	}
+	return proxies[0], nil
+}
+
+// lease up to n distinct proxies chosen one after the other by the channel strategy, in one script,
+// skipping the ones taken already.
+// ARGV: 28 count, 29 proxy failure limit, 30 and after the members to skip
+func (p *ProxyPool) selectLeases(criteria *Criteria, n int, taken []*Member) ([]*Member, error) {
+	c := p.pool.Get()
+	defer c.Close()
+
+	if err := c.Err(); err != nil {
+		return nil, err
+	}
+
+	script, found := strategyScripts[p.config().Strategy]
+	if !found {
+		return nil, validStrategy(p.config().Strategy)
+	}
+
+	args := p.leaseArgs(p.keys.poolRttKey(p.channel), p.keys.poolHealthKey(p.channel), p.keys.poolCooldownKey(p.channel),
+		p.keys.poolBanditKey(p.channel), p.keys.poolRecentKey(p.channel), p.keys.poolSubnetBlockedKey(p.channel))
+	args = args.Add(p.config().SelectionScanLimit, selectionScanBatch, rand.Int31())
+	criteria = p.channelCriteria(criteria)
+	var host string
+	if criteria == nil {
+		args = args.Add(0, 0, 0, "", "", "", "")
+	} else {
+		args = args.Add(1, criteria.MinAnonymity, criteria.MaxRtt, criteria.Country, criteria.Region,
+			strings.Join(criteria.Protocols, ","), strings.Join(criteria.Labels, ","))
+		host = criteria.Host
+	}
+	args = args.Add(defaultHealthWeight, p.nowMillis(), p.bucketPrefix(host), p.config().TargetRate, p.config().TargetBurst)
+	if host == "" {
+		args = args.Add("")
+	} else {
+		args = args.Add(p.keys.burnKey(host))
+	}
+	args = args.Add(int64(p.config().BanditHalfLife/time.Millisecond), p.config().BanditExploreRate)
+	args = args.Add(p.config().Diversity, int64(p.config().DiversityWindow/time.Millisecond), p.config().SubnetFailureLimit > 0)
+	args = args.Add(n, p.config().ProxyFailureLimit)
+	for _, proxy := range taken {
+		args = args.Add(proxy.Member)
+	}
+	return parseLeases(script.Do(c, args...))
+}
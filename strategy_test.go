@@ -0,0 +1,33 @@
+package proxypool
+
+import (
+	"fmt"
+	"testing"
+)
+
+func TestStrategyFastestInChannel(t *testing.T) {
+	pp := newTestPool(t, "fastest", func(c *Config) {
+		c.Pool.Strategy = StrategyFastest
+		c.Pool.SelectionScanLimit = 5
+	})
+
+	// the fastest proxies of proxy center are blocked in channel, more of them than the scan limit and batch
+	for i := 1; i <= selectionScanBatch+10; i++ {
+		member := fmt.Sprintf("10.0.0.%d:80", i)
+		if err := zadd(pp.keys.poolBlockedKey(pp.channel), member, pp.blockEnd(), pp.pool); err != nil {
+			t.Fatal(err)
+		}
+		addTestProxy(t, pp, member, i)
+	}
+	addTestProxy(t, pp, "10.0.1.1:80", 100)
+	addTestProxy(t, pp, "10.0.1.2:80", 50)
+	addTestProxy(t, pp, "10.0.1.3:80", 70)
+	awaitChannel(t, pp, 3)
+
+	for _, want := range []string{"10.0.1.2:80", "10.0.1.3:80", "10.0.1.1:80"} {
+		proxy := pp.Take()
+		if proxy == nil || proxy.Member != want {
+			t.Fatalf("took %v, want %s", proxy, want)
+		}
+	}
+}
@@ -1,7 +1,7 @@
 package proxypool
 
 import (
-	"fmt"
+	"net"
 	"time"
 
 	request "github.com/imroc/req"
@@ -9,20 +9,20 @@ import (
 )
 
 // check if a proxy is availale, return the rtt, anonymity
-func validateProxy(ip, port string) (int, int, bool) {
-	proxyUrl := fmt.Sprintf("http://%s:%s", ip, port)
+func validateProxy(ip, port, judgeUrl string, timeout time.Duration) (int, int, bool) {
+	proxyUrl := "http://" + net.JoinHostPort(ip, port)
 
 	start := time.Now()
 
 	req := request.New()
-	req.SetTimeout(validationTimeout)
+	req.SetTimeout(timeout)
 	// set proxy
 	req.SetProxyUrl(proxyUrl)
 
 	input := make(map[string]interface{})
 	input["ip"] = ip
 
-	resp, err := req.Get(validationUrl, request.QueryParam(input))
+	resp, err := req.Get(judgeUrl, request.QueryParam(input))
 	if err != nil {
 		log.Error(err)
 		return 0, 0, false
@@ -44,3 +44,54 @@ func validateProxy(ip, port string) (int, int, bool) {
 	rtt := time.Since(start) / time.Millisecond
 	return int(rtt), r.Anonymity, true
 }
+
+// check if the proxy can reach an https url through CONNECT
+func validateHTTPS(ip, port, judgeUrl string, timeout time.Duration) bool {
+	req := request.New()
+	req.SetTimeout(timeout)
+	req.SetProxyUrl("http://" + net.JoinHostPort(ip, port))
+
+	resp, err := req.Get(judgeUrl)
+	if err != nil {
+		return false
+	}
+	return resp.Response().StatusCode < 500
+}
+
+// validate the proxy, save it to the global pool if valid, otherwise remove it and add it to blocked.
+func (w *ValidationWorker) checkProxy(proxyStr string) {
+	ip, port, err := net.SplitHostPort(proxyStr)
+	if err != nil {
+		log.Errorf("invalid proxy [%s]", proxyStr)
+		return
+	}
+
+	rtt, anonymity, valid := validateProxy(ip, port, w.conf.ValidationURL, w.conf.ValidationTimeout)
+	if !valid {
+		// if proxy is not valid, remove it from global pool.
+		if err := deleteProxy(ip, port, w.keys, w.pool); err != nil {
+			log.Error(err)
+		}
+
+		// after remove the invalid proxy, add it to blocked proxy
+		ts := time.Now().Unix()
+		if err := zadd(w.keys.blockedSet(), proxyStr, ts, w.pool); err != nil {
+			log.Error(err)
+		}
+	} else {
+		// remove proxy from blocked
+		zrem(w.keys.blockedSet(), proxyStr, w.pool)
+
+		// save to proxy
+		var proxy Proxy
+		proxy.Ip = ip
+		proxy.Port = port
+		proxy.Rtt = rtt
+		proxy.Anonymity = anonymity
+		proxy.ValidatedAt = time.Now().Unix()
+		if w.conf.ValidationHTTPSURL != "" {
+			proxy.Https = validateHTTPS(ip, port, w.conf.ValidationHTTPSURL, w.conf.ValidationTimeout)
+		}
+		saveProxy(&proxy, w.keys, w.pool)
+	}
+}
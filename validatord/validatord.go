@@ -0,0 +1,46 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"os"
+	"os/signal"
+	"syscall"
+
+	"github.com/seaguest/log"
+	"github.com/seaguest/proxypool"
+)
+
+// standalone validation worker, run it on as many hosts as needed against the same redis.
+// the configuration is loaded from the file, then overridden by PROXYPOOL_* environment variables.
+func main() {
+	path := flag.String("config", "", "yaml or json config file")
+	flag.Parse()
+
+	conf, err := proxypool.LoadConfig(*path)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	if err := conf.LoadEnv(); err != nil {
+		log.Fatal(err)
+	}
+
+	worker, err := proxypool.NewValidationWorkerWithConfig(conf)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	// drain in-flight validations on exit
+	ctx, cancel := context.WithCancel(context.Background())
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		<-sig
+		cancel()
+	}()
+
+	if err := worker.Run(ctx); err != nil {
+		log.Error(err)
+	}
+}
@@ -0,0 +1,304 @@
+package proxypool
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math/rand"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/garyburd/redigo/redis"
+	"github.com/seaguest/log"
+)
+
+const (
+	defaultWaitRetryPeriod = time.Second * 1  // in seconds
+	waitAliveTTL           = time.Second * 10 // in seconds
+	waitBlockTimeout       = 1                // in seconds, BLPOP timeout of the dispatcher
+)
+
+// suffix of the id of a waiter only woken up to retry
+const waitRetryOnly = "*"
+
+var errPoolClosed = errors.New("proxy pool closed")
+
+// a TakeContext call waiting in the waiters list of channel.
+type waiter struct {
+	id    string
+	entry string
+	c     chan *Member
+}
+
+// waiters of this process, woken up by the dispatch loop.
+type waitQueue struct {
+	// process id, unique among the processes sharing the channel
+	proc string
+
+	mu      sync.Mutex
+	seq     uint64
+	waiters map[string]*waiter
+}
+
+func newWaitQueue() *waitQueue {
+	q := &waitQueue{}
+	q.proc = fmt.Sprintf("%d-%x", os.Getpid(), rand.Int63())
+	q.waiters = make(map[string]*waiter)
+	return q
+}
+
+// a waiter with criteria is only woken up to retry, a proxy handed over may not match them.
+func (q *waitQueue) newWaiter(deadline int64, criteria *Criteria) *waiter {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	q.seq++
+	id := strconv.FormatUint(q.seq, 10)
+	if criteria != nil {
+		id += waitRetryOnly
+	}
+	return &waiter{id: id, entry: fmt.Sprintf("%s|%s|%d", q.proc, id, deadline), c: make(chan *Member, 1)}
+}
+
+func (q *waitQueue) add(w *waiter) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.waiters[w.id] = w
+}
+
+func (q *waitQueue) remove(w *waiter) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	delete(q.waiters, w.id)
+}
+
+// deliver the wake up to the waiter, false if it is no longer waiting.
+func (q *waitQueue) deliver(id string, proxy *Member) bool {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	w, ok := q.waiters[id]
+	if !ok {
+		return false
+	}
+	delete(q.waiters, id)
+	w.c <- proxy
+	return true
+}
+
+// take a proxy like Take, but wait until one is freed or reclaimed if none is available.
+// waiters are served in arrival order across all the processes sharing the channel,
+// ctx.Err() is returned if ctx is done before.
+func (p *ProxyPool) TakeContext(ctx context.Context) (*Member, error) {
+	return p.TakeContextWith(ctx, nil)
+}
+
+// take a proxy matching the criteria like TakeWith, but wait like TakeContext if none is available.
+// a waiter with criteria retries when a proxy is freed, instead of being handed it.
+func (p *ProxyPool) TakeContextWith(ctx context.Context, criteria *Criteria) (*Member, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	// take at once unless others are already waiting
+	n, err := p.countWaiters()
+	if err != nil {
+		return nil, err
+	}
+	if n == 0 {
+		if proxy := p.TakeWith(criteria); proxy != nil {
+			return proxy, nil
+		}
+	}
+
+	var deadline int64
+	if d, ok := ctx.Deadline(); ok {
+		deadline = d.UnixNano() / int64(time.Millisecond)
+	}
+
+	w := p.waits.newWaiter(deadline, criteria)
+	if err := p.enqueueWaiter(w, false); err != nil {
+		return nil, err
+	}
+
+	ticker := time.NewTicker(p.config().WaitRetryPeriod)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			p.cancelWaiter(w)
+			return nil, ctx.Err()
+		case <-p.runner.ctx.Done():
+			p.cancelWaiter(w)
+			return nil, errPoolClosed
+		case proxy := <-w.c:
+			if proxy != nil {
+				return proxy, nil
+			}
+
+			// woken up after a reload, retry ahead of the others
+			if proxy := p.TakeWith(criteria); proxy != nil {
+				return proxy, nil
+			}
+			if err := p.enqueueWaiter(w, true); err != nil {
+				return nil, err
+			}
+		case <-ticker.C:
+			// the first waiter reloads the channel, in case proxies were added to proxy_center
+			if proxy := p.retryFirst(w, criteria); proxy != nil {
+				return proxy, nil
+			}
+		}
+	}
+}
+
+// remove the waiter if first, after dropping the waiters ahead of it whose process is dead or deadline passed,
+// so that they do not hold the head of the list. return 0 if the waiter is not first, or was popped meanwhile.
+// KEYS: 1 waiters; ARGV: 1 waiter, 2 now, 3 alive prefix
+var retryFirstScript = redis.NewScript(1, `
+	while true do
+	    local w = redis.call('LINDEX', KEYS[1], 0)
+	    if not w then
+	        return 0
+	    end
+	    if w == ARGV[1] then
+	        return redis.call('LREM', KEYS[1], 1, w)
+	    end
+	    local proc, id, deadline = string.match(w, '^(.-)|(.-)|(%d+)$')
+	    deadline = tonumber(deadline)
+	    if proc and (deadline == 0 or deadline > tonumber(ARGV[2])) and redis.call('EXISTS', ARGV[3] .. proc) == 1 then
+	        return 0
+	    end
+	    redis.call('LREM', KEYS[1], 1, w)
+	end`)
+
+// retry to take a proxy if w is the first waiter, nil if not first or none available.
+func (p *ProxyPool) retryFirst(w *waiter, criteria *Criteria) *Member {
+	c := p.pool.Get()
+	defer c.Close()
+
+	// a wake up is on its way if w was popped meanwhile
+	removed, err := redis.Int(retryFirstScript.Do(c, p.keys.poolWaitersKey(p.channel), w.entry,
+		p.nowMillis(), p.keys.poolAlivePrefix(p.channel)))
+	if err != nil || removed == 0 {
+		if err != nil {
+			log.Error(err)
+		}
+		return nil
+	}
+	p.waits.remove(w)
+
+	if proxy := p.TakeWith(criteria); proxy != nil {
+		return proxy
+	}
+	if err := p.enqueueWaiter(w, true); err != nil {
+		log.Error(err)
+	}
+	return nil
+}
+
+// register the waiter locally then in channel, at the head of the list if front.
+func (p *ProxyPool) enqueueWaiter(w *waiter, front bool) error {
+	c := p.pool.Get()
+	defer c.Close()
+
+	p.waits.add(w)
+
+	push := "RPUSH"
+	if front {
+		push = "LPUSH"
+	}
+
+	// the process must be alive before being handed a proxy
+	c.Send("SET", p.keys.poolAlivePrefix(p.channel)+p.waits.proc, 1, "PX", int64(waitAliveTTL/time.Millisecond))
+	c.Send(push, p.keys.poolWaitersKey(p.channel), w.entry)
+	if _, err := c.Do(""); err != nil {
+		p.waits.remove(w)
+		return err
+	}
+	return nil
+}
+
+// stop waiting, the proxy handed to the waiter meanwhile if any is freed.
+func (p *ProxyPool) cancelWaiter(w *waiter) {
+	// a wake up arriving after removal is handled by the dispatch loop
+	p.waits.remove(w)
+
+	c := p.pool.Get()
+	defer c.Close()
+
+	if _, err := c.Do("LREM", p.keys.poolWaitersKey(p.channel), 1, w.entry); err != nil {
+		log.Error(err)
+	}
+
+	select {
+	case proxy := <-w.c:
+		if proxy != nil {
+			p.Free(proxy)
+		}
+	default:
+	}
+}
+
+func (p *ProxyPool) countWaiters() (int, error) {
+	c := p.pool.Get()
+	defer c.Close()
+
+	return redis.Int(c.Do("LLEN", p.keys.poolWaitersKey(p.channel)))
+}
+
+// route the wake ups of this process to its waiters, and keep the process alive in channel.
+func (p *ProxyPool) dispatch(ctx context.Context) {
+	aliveKey := p.keys.poolAlivePrefix(p.channel) + p.waits.proc
+	wakeKey := p.keys.poolWakePrefix(p.channel) + p.waits.proc
+
+	for ctx.Err() == nil {
+		if err := p.receiveWakeUps(aliveKey, wakeKey); err != nil && ctx.Err() == nil {
+			log.Error(err)
+			sleep(ctx, time.Second)
+		}
+	}
+
+	// no proxy is handed to this process any longer
+	c := p.pool.Get()
+	defer c.Close()
+	c.Do("DEL", aliveKey)
+}
+
+func (p *ProxyPool) receiveWakeUps(aliveKey, wakeKey string) error {
+	c := p.pool.Get()
+	defer c.Close()
+
+	if _, err := c.Do("SET", aliveKey, 1, "PX", int64(waitAliveTTL/time.Millisecond)); err != nil {
+		return err
+	}
+
+	reply, err := redis.Strings(c.Do("BLPOP", wakeKey, waitBlockTimeout))
+	if err == redis.ErrNil {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	// a message is id, or id|score|lease when a proxy is handed, the lease being member|seq
+	parts := strings.SplitN(reply[1], "|", 3)
+	var proxy *Member
+	if len(parts) == 3 {
+		proxy = &Member{Lease: parts[2]}
+		proxy.Member = parts[2][:strings.LastIndex(parts[2], "|")]
+		proxy.Score, _ = strconv.Atoi(parts[1])
+	}
+
+	if !p.waits.deliver(parts[0], proxy) && proxy != nil {
+		// the waiter gave up, pass the proxy on
+		if _, err := p.freeLease(proxy, 0); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,72 @@
+package proxypool
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestTakeContextSkipsStaleWaiters(t *testing.T) {
+	pp := newTestPool(t, "wait", func(c *Config) {
+		c.Pool.WaitRetryPeriod = time.Millisecond * 50
+	})
+	addTestProxy(t, pp, "10.0.0.1:80", 10)
+	pp.reload()
+
+	// a waiter of a dead process, and one of this process past its deadline, ahead of the others
+	c := pp.pool.Get()
+	_, err := c.Do("RPUSH", pp.keys.poolWaitersKey(pp.channel), "dead|1|0", pp.waits.proc+"|0|1")
+	c.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*2)
+	defer cancel()
+
+	proxy, err := pp.TakeContext(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if proxy.Member != "10.0.0.1:80" {
+		t.Fatalf("took %s", proxy.Member)
+	}
+	if n, err := pp.countWaiters(); err != nil || n != 0 {
+		t.Fatalf("%d waiters left, %v", n, err)
+	}
+}
+
+func TestTakeContextAfterCooldown(t *testing.T) {
+	pp := newTestPool(t, "cooldown", func(c *Config) {
+		c.Pool.Cooldown = time.Millisecond * 200
+		c.Pool.WaitRetryPeriod = time.Minute
+	})
+	addTestProxy(t, pp, "10.0.0.1:80", 10)
+	pp.reload()
+
+	// each waiter frees the proxy once taken, handing it to the next one after the cooldown
+	const waiters = 4
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*5)
+	defer cancel()
+
+	start := time.Now()
+	errs := make(chan error, waiters)
+	for i := 0; i < waiters; i++ {
+		go func() {
+			proxy, err := pp.TakeContext(ctx)
+			if err == nil {
+				pp.Free(proxy)
+			}
+			errs <- err
+		}()
+	}
+	for i := 0; i < waiters; i++ {
+		if err := <-errs; err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if d := time.Since(start); d > time.Second {
+		t.Errorf("%d waiters served in %s", waiters, d)
+	}
+}